@@ -0,0 +1,576 @@
+// Scheduled snapshot daemon for the snapshot manager
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/memset/snapshot-manager/snapshot"
+)
+
+const (
+	// Default name of the file the daemon keeps its state in
+	stateFileName = ".snapshot-manager.state"
+	// Images in a watched directory must be unchanged for this long
+	// before they are uploaded in case they are still being written
+	settleTime = time.Minute
+)
+
+// Schedule is a snapshot upload run by the daemon set up in the
+// config file as
+//
+//	[schedules.name]
+//	cron = "30 2 * * *"
+//	dir = "/var/backups/web1"
+//	miniserver = "web1"
+//	keep = 7
+type Schedule struct {
+	Cron       string // when to run in crontab format
+	Dir        string // upload the newest image in this directory
+	Command    string // or upload the output of this command
+	Type       string // type of the image the command outputs, eg raw
+	Miniserver string // Miniserver to set on the snapshot
+	Comment    string // comment to set on the snapshot
+	Keep       int    // number of snapshots of the Miniserver to keep
+	KeepFor    string // how long to keep snapshots of the Miniserver for, eg 30d
+}
+
+// scheduleRun is the state of a schedule saved between runs
+type scheduleRun struct {
+	LastRun      time.Time // when it last ran
+	LastSuccess  time.Time // when it last ran without error
+	LastError    string    // the error from the last run if it failed
+	LastSnapshot string    // the last snapshot it uploaded
+	LastFile     string    // the last file uploaded from the directory
+	LastModified time.Time // modification time of LastFile
+}
+
+// daemonState is the state of all the schedules which is saved to
+// disk so the daemon carries on where it left off when restarted
+type daemonState struct {
+	mu   sync.Mutex
+	path string
+	runs map[string]scheduleRun // by schedule name
+}
+
+// loadDaemonState reads the state from path or starts with an empty
+// one if it doesn't exist
+func loadDaemonState(path string) (*daemonState, error) {
+	st := &daemonState{
+		path: path,
+		runs: map[string]scheduleRun{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &st.runs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %q: %v", path, err)
+	}
+	return st, nil
+}
+
+// get returns the state of the schedule name
+func (st *daemonState) get(name string) scheduleRun {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.runs[name]
+}
+
+// set updates the state of the schedule name and saves it
+//
+// The state is written to a temporary file which is renamed over the
+// old one so it is never left half written.
+func (st *daemonState) set(name string, run scheduleRun) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.runs[name] = run
+	data, err := json.MarshalIndent(st.runs, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := st.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// daemonJob is a schedule the daemon runs
+type daemonJob struct {
+	name      string
+	Schedule  Schedule
+	cron      *snapshot.Cron
+	imageType *snapshot.Type // type of the command output
+	retention snapshot.Retention
+	next      time.Time // when it next runs
+	running   bool
+}
+
+// scheduleResult is the result of a run of a schedule
+type scheduleResult struct {
+	Snapshot string   `json:"snapshot,omitempty"`
+	File     string   `json:"file,omitempty"`
+	Deleted  []string `json:"deleted,omitempty"`
+}
+
+// daemon runs the schedules
+type daemon struct {
+	sm    *snapshot.Manager
+	state *daemonState
+	jobs  *Jobs
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	sched []*daemonJob
+}
+
+// newDaemon checks the schedules and makes a daemon to run them
+func newDaemon(sm *snapshot.Manager, schedules map[string]Schedule, state *daemonState, jobs *Jobs) (*daemon, error) {
+	d := &daemon{
+		sm:    sm,
+		state: state,
+		jobs:  jobs,
+	}
+	for name, schedule := range schedules {
+		job := &daemonJob{
+			name:     name,
+			Schedule: schedule,
+		}
+		var err error
+		job.cron, err = snapshot.ParseCron(schedule.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("schedule %q: %v", name, err)
+		}
+		switch {
+		case schedule.Dir != "" && schedule.Command != "":
+			return nil, fmt.Errorf(`schedule %q: use only one of "dir" and "command"`, name)
+		case schedule.Dir != "":
+		case schedule.Command != "":
+			if schedule.Type == "" {
+				return nil, fmt.Errorf(`schedule %q: need "type" of the image the command outputs, eg "raw"`, name)
+			}
+			job.imageType = snapshot.Types.Find("." + strings.TrimPrefix(schedule.Type, "."))
+			if job.imageType == nil || !job.imageType.Upload {
+				return nil, fmt.Errorf("schedule %q: can't upload images of type %q - use types command to see available", name, schedule.Type)
+			}
+		default:
+			return nil, fmt.Errorf(`schedule %q: need "dir" or "command"`, name)
+		}
+		if schedule.Miniserver == "" {
+			job.Schedule.Miniserver = name
+		}
+		job.retention.Keep = schedule.Keep
+		if schedule.KeepFor != "" {
+			job.retention.MaxAge, err = snapshot.ParseDuration(schedule.KeepFor)
+			if err != nil {
+				return nil, fmt.Errorf(`schedule %q: bad "keepfor": %v`, name, err)
+			}
+		}
+		d.sched = append(d.sched, job)
+	}
+	if len(d.sched) == 0 {
+		return nil, fmt.Errorf("no schedules in the config file")
+	}
+	sort.Slice(d.sched, func(i, j int) bool { return d.sched[i].name < d.sched[j].name })
+	return d, nil
+}
+
+// Run the schedules until ctx is cancelled then wait for any running
+// jobs to finish
+func (d *daemon) Run(ctx context.Context) {
+	now := time.Now()
+	for _, job := range d.sched {
+		lastRun := d.state.get(job.name).LastRun
+		if lastRun.IsZero() {
+			job.next = job.cron.Next(now)
+		} else {
+			job.next = job.cron.Next(lastRun)
+			if job.next.Before(now) {
+				log.Printf("Schedule %q missed its run at %v - running it now", job.name, job.next)
+			}
+		}
+		if job.next.IsZero() {
+			log.Printf("Schedule %q never runs", job.name)
+			continue
+		}
+		log.Printf("Schedule %q next runs at %v", job.name, job.next)
+	}
+	for {
+		// Start the jobs which are due and find when the next is
+		now = time.Now()
+		var wake time.Time
+		for _, job := range d.sched {
+			if job.next.IsZero() {
+				continue
+			}
+			if !job.next.After(now) {
+				d.start(job)
+				job.next = job.cron.Next(now)
+			}
+			if wake.IsZero() || job.next.Before(wake) {
+				wake = job.next
+			}
+		}
+		if wake.IsZero() {
+			log.Printf("No schedules left to run")
+			break
+		}
+		timer := time.NewTimer(time.Until(wake))
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		break
+	}
+	d.wg.Wait()
+}
+
+// start runs the job in the background unless it is still running
+// from last time
+func (d *daemon) start(job *daemonJob) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if job.running {
+		log.Printf("Schedule %q still running from last time - skipping this run", job.name)
+		return
+	}
+	job.running = true
+	d.wg.Add(1)
+	name := job.name + "." + time.Now().Format(snapshot.DirectoryDate)
+	d.jobs.Start("schedule "+job.name, name, func() (interface{}, error) {
+		defer d.wg.Done()
+		result, err := d.runJob(job, name)
+		d.mu.Lock()
+		job.running = false
+		d.mu.Unlock()
+		return result, err
+	})
+}
+
+// runJob uploads the snapshot name for the job, applies the retention
+// rules and saves the outcome in the state
+func (d *daemon) runJob(job *daemonJob, name string) (result *scheduleResult, err error) {
+	run := d.state.get(job.name)
+	run.LastRun = time.Now()
+	start := run.LastRun
+	result = &scheduleResult{}
+	defer func() {
+		if err != nil {
+			run.LastError = err.Error()
+			log.Printf("Schedule %q failed: %v", job.name, err)
+		} else {
+			run.LastError = ""
+			run.LastSuccess = run.LastRun
+		}
+		stateErr := d.state.set(job.name, run)
+		if stateErr != nil {
+			log.Printf("Failed to save daemon state: %v", stateErr)
+		}
+	}()
+
+	// Check first so a failed upload can be cleaned up safely
+	ok, err := d.sm.NewSnapshot(name).Exists()
+	if err != nil {
+		return result, err
+	}
+	if ok {
+		return result, fmt.Errorf("snapshot %q already exists", name)
+	}
+
+	if job.Schedule.Dir != "" {
+		var file string
+		var fi os.FileInfo
+		file, fi, err = newestImage(job.Schedule.Dir)
+		if err != nil {
+			return result, err
+		}
+		if file == run.LastFile && fi.ModTime().Equal(run.LastModified) {
+			log.Printf("Schedule %q: no new image in %q since %q", job.name, job.Schedule.Dir, file)
+			return result, nil
+		}
+		result.File = file
+		err = d.uploadFile(job, name, file)
+		if err != nil {
+			return result, err
+		}
+		run.LastFile, run.LastModified = file, fi.ModTime()
+	} else {
+		err = d.uploadCommand(job, name)
+		if err != nil {
+			return result, err
+		}
+	}
+	result.Snapshot = name
+	run.LastSnapshot = name
+	log.Printf("Schedule %q: uploaded snapshot %q in %v", job.name, name, time.Since(start).Truncate(time.Second))
+
+	result.Deleted, err = d.applyRetention(job)
+	return result, err
+}
+
+// newestImage finds the newest file in dir which can be uploaded and
+// hasn't been modified for settleTime
+func newestImage(dir string) (file string, fi os.FileInfo, err error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+	settled := time.Now().Add(-settleTime)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		Type := snapshot.Types.Find(strings.ToLower(entry.Name()))
+		if Type == nil || !Type.Upload {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", nil, err
+		}
+		if info.ModTime().After(settled) {
+			continue
+		}
+		if fi == nil || info.ModTime().After(fi.ModTime()) {
+			file, fi = filepath.Join(dir, entry.Name()), info
+		}
+	}
+	if fi == nil {
+		return "", nil, fmt.Errorf("no images which can be uploaded in %q", dir)
+	}
+	return file, fi, nil
+}
+
+// setScheduleMetadata sets the Miniserver and comment of the job on
+// the snapshot
+func setScheduleMetadata(s *snapshot.Snapshot, job *daemonJob) {
+	s.Miniserver = job.Schedule.Miniserver
+	if job.Schedule.Comment != "" {
+		s.Comment = job.Schedule.Comment
+	}
+	err := s.SetTag("schedule", job.name)
+	if err != nil {
+		log.Printf("Couldn't tag snapshot %q: %v", s.Name, err)
+	}
+}
+
+// uploadFile uploads file as the snapshot name
+func (d *daemon) uploadFile(job *daemonJob, name, file string) error {
+	s := d.sm.NewSnapshotForUpload(name, file)
+	setScheduleMetadata(s, job)
+	log.Printf("Schedule %q: uploading %q as snapshot %q", job.name, file, name)
+	err := s.Put(file)
+	if err != nil {
+		cleanUp(s)
+		return fmt.Errorf("failed to upload %q: %v", file, err)
+	}
+	return nil
+}
+
+// commandReader reads the output of a command, returning an error
+// instead of io.EOF if the command fails so a partial image is never
+// made into a snapshot
+type commandReader struct {
+	cmd  *exec.Cmd
+	out  io.ReadCloser
+	done bool
+	err  error
+}
+
+// Read the output of the command
+func (r *commandReader) Read(p []byte) (n int, err error) {
+	n, err = r.out.Read(p)
+	if err == io.EOF {
+		if !r.done {
+			r.done = true
+			r.err = r.cmd.Wait()
+		}
+		if r.err != nil {
+			return n, fmt.Errorf("command failed: %v", r.err)
+		}
+	}
+	return n, err
+}
+
+// Close stops the command if it is still running
+func (r *commandReader) Close() error {
+	if !r.done {
+		r.done = true
+		_ = r.cmd.Process.Kill()
+		_ = r.cmd.Wait()
+	}
+	return nil
+}
+
+// uploadCommand uploads the output of the command of the job as the
+// snapshot name
+func (d *daemon) uploadCommand(job *daemonJob, name string) (err error) {
+	leaf := job.name + job.imageType.Suffix
+	s := d.sm.NewSnapshotForUpload(name, leaf)
+	s.Comment = fmt.Sprintf("Uploaded from the output of '%s'", job.Schedule.Command)
+	setScheduleMetadata(s, job)
+	cmd := exec.Command("sh", "-c", job.Schedule.Command)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	log.Printf("Schedule %q: uploading the output of %q as snapshot %q", job.name, job.Schedule.Command, name)
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to run command: %v", err)
+	}
+	in := &commandReader{cmd: cmd, out: out}
+	defer checkClose(in, &err)
+	err = s.PutStream(in, -1)
+	if err != nil {
+		cleanUp(s)
+		return fmt.Errorf("failed to upload: %v", err)
+	}
+	return nil
+}
+
+// checkClose closes c, setting *err if it was nil
+func checkClose(c io.Closer, err *error) {
+	closeErr := c.Close()
+	if *err == nil {
+		*err = closeErr
+	}
+}
+
+// cleanUp deletes whatever a failed upload of s left behind, logging
+// any error as the upload has already failed
+func cleanUp(s *snapshot.Snapshot) {
+	err := s.CleanUp()
+	if err != nil {
+		log.Printf("Failed to clean up snapshot %q: %v", s.Name, err)
+	}
+}
+
+// applyRetention deletes the snapshots of the Miniserver of the job
+// which its retention rules say are no longer needed
+func (d *daemon) applyRetention(job *daemonJob) (deleted []string, err error) {
+	if !job.retention.IsSet() {
+		return nil, nil
+	}
+	snapshots, err := d.sm.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots for retention: %v", err)
+	}
+	snapshots = snapshot.Select(snapshots, snapshot.OfMiniserver(job.Schedule.Miniserver))
+	failed := 0
+	for _, s := range job.retention.Expired(snapshots, time.Now()) {
+		log.Printf("Schedule %q: deleting snapshot %q from %v", job.name, s.Name, s.Date)
+		err = s.Delete()
+		if err != nil {
+			failed++
+			log.Printf("Failed to delete snapshot %q: %v", s.Name, err)
+			continue
+		}
+		deleted = append(deleted, s.Name)
+	}
+	if failed != 0 {
+		return deleted, fmt.Errorf("failed to delete %d old snapshots", failed)
+	}
+	return deleted, nil
+}
+
+// Run the daemon
+func runDaemon() {
+	stateFile := Config.StateFile
+	if stateFile == "" {
+		stateFile = path.Join(homeDir, stateFileName)
+	}
+	state, err := loadDaemonState(stateFile)
+	if err != nil {
+		log.Fatalf("Failed to read daemon state: %v", err)
+	}
+	jobs := NewJobs()
+	d, err := newDaemon(sm, Config.Schedules, state, jobs)
+	if err != nil {
+		log.Fatalf("Bad schedule: %v", err)
+	}
+
+	// Stop on the first signal, waiting for running jobs, and exit
+	// straight away on the second
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %v - waiting for running jobs to finish - send it again to stop now", sig)
+		cancel()
+		sig = <-signals
+		log.Fatalf("Got %v - stopping now", sig)
+	}()
+
+	// Serve the metrics, and the API with the daemon's jobs if there
+	// is a token, only if asked to so nothing is exposed by default
+	var srv *http.Server
+	if flagGiven("listen") || Config.Token != "" {
+		mux := http.NewServeMux()
+		handler := http.Handler(mux)
+		if Config.Token != "" {
+			api := NewServer(sm, Config.Token)
+			api.jobs = jobs
+			mux = api.mux
+			handler = api
+		}
+		mux.Handle("/metrics", sm.Metrics)
+		srv = &http.Server{Addr: listen, Handler: handler}
+		go func() {
+			log.Printf("Serving on %s", listen)
+			err := srv.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Failed to serve: %v", err)
+			}
+		}()
+	}
+	if srv != nil || Config.MetricsFile != "" {
+		go refreshMetrics(ctx.Done())
+	}
+
+	log.Printf("Daemon started with %d schedules - state in %q", len(d.sched), stateFile)
+	d.Run(ctx)
+	if srv != nil {
+		err = srv.Shutdown(context.Background())
+		if err != nil {
+			log.Printf("Failed to stop serving: %v", err)
+		}
+	}
+	log.Printf("Daemon stopped")
+}
+
+// flagGiven returns whether the flag called name was set on the
+// command line
+func flagGiven(name string) (given bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
@@ -3,6 +3,8 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ed25519"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +13,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/memset/snapshot-manager/snapshot"
@@ -20,6 +23,7 @@ import (
 const (
 	configFileName   = ".snapshot-manager.conf"
 	chunkSizeDefault = 64 * 1024 * 1024
+	passphraseEnv    = "SNAPSHOT_PASSPHRASE"
 )
 
 // Globals
@@ -32,22 +36,158 @@ var (
 	configFile string
 	// Snapshot manager
 	sm *snapshot.Manager
+	// Flags for individual commands
+	deep      bool
+	signature bool
+	pubkey    string
+	repair    bool
+	remove    bool
+	dryRun    bool
+	minAge    time.Duration
+	// Flags for selecting snapshots
+	match      string
+	before     string
+	miniserver string
+	broken     bool
+	yes        bool
+	since      string
+	until      string
+	imageType  string
+	sortBy     string
+	reverse    bool
+	trash      bool
+	sizes      bool
+	// Flags for uploading
+	expireAfter string
+	expireAt    string
+	comment     string
+	tags        tagFlags
+	// Flags for sharing
+	expires string
+	// Flags for transferring
+	toProfile string
+	// Flags for serving
+	listen string
 )
 
-var Config, flagsConfig struct {
+// Profile is another Memstore account set up in the config file as
+//
+//	[profiles.name]
+//	user = "myaccaa2.admin"
+//	password = "string"
+type Profile struct {
 	User      string
 	Password  string
 	AuthUrl   string
-	ChunkSize int
+	Container string
+}
+
+// tagFlags collects the -tag flags
+type tagFlags []string
+
+// String returns the tags as a string
+func (t *tagFlags) String() string {
+	return strings.Join(*t, ",")
+}
+
+// Set adds a tag
+func (t *tagFlags) Set(tag string) error {
+	if !strings.Contains(tag, "=") {
+		return fmt.Errorf("tag %q should be key=value", tag)
+	}
+	*t = append(*t, tag)
+	return nil
+}
+
+// setMetadata sets the comment, miniserver and tags from the flags
+// on the snapshot
+func setMetadata(s *snapshot.Snapshot) {
+	if comment != "" {
+		s.Comment = comment
+	}
+	if miniserver != "" {
+		s.Miniserver = miniserver
+	}
+	for _, tag := range tags {
+		tokens := strings.SplitN(tag, "=", 2)
+		err := s.SetTag(tokens[0], tokens[1])
+		if err != nil {
+			log.Fatalf("Bad -tag: %v", err)
+		}
+	}
+}
+
+var Config, flagsConfig struct {
+	User            string
+	Password        string
+	AuthUrl         string
+	ChunkSize       int
+	CompressLevel   int
+	CompressThreads int
+	Decompress      bool
+	SoftDelete      bool
+	TrashExpire     string
+	CacheFile       string
+	KeyFile         string
+	Passphrase      string
+	SignKey         string
+	TempUrlKey      string
+	BwLimit         string
+	Token           string
+	StateFile       string
+	MetricsFile     string
+	Profiles        map[string]Profile
+	Schedules       map[string]Schedule
 }
 
 // Flags
 func init() {
 	Config.ChunkSize = chunkSizeDefault
 	flag.StringVar(&configFile, "config", defaultConfigPath, "Path to config file")
+	flag.BoolVar(&deep, "deep", false, "Read the whole image to check its MD5 when verifying")
+	flag.BoolVar(&signature, "signature", false, "Check the signature of the README.txt when verifying - use with -pubkey")
+	flag.StringVar(&pubkey, "pubkey", "", "PEM file with the ed25519 public key to check signatures with")
+	flag.BoolVar(&repair, "repair", false, "Repair the problems fsck finds where possible")
+	flag.BoolVar(&remove, "delete", false, "Delete the leftovers fsck can't repair or the chunks gc finds")
+	flag.BoolVar(&dryRun, "dry-run", false, "Show what fsck or gc would do without doing it")
+	flag.StringVar(&match, "match", "", "Select snapshots whose names match this glob, eg 'myacc.2014-*'")
+	flag.StringVar(&before, "before", "", "Select snapshots made before this date, eg 2015-06-01")
+	flag.StringVar(&miniserver, "miniserver", "", "Select snapshots of this Miniserver or set it on upload or edit")
+	flag.BoolVar(&broken, "broken", false, "Select broken snapshots")
+	flag.BoolVar(&broken, "broken-only", false, "Same as -broken")
+	flag.StringVar(&since, "since", "", "Select snapshots made on or after this date, eg 2015-06-01")
+	flag.StringVar(&until, "until", "", "Select snapshots made on or before this date, eg 2015-06-01")
+	flag.StringVar(&imageType, "type", "", "Select snapshots with this type of image, eg raw or tar, or set it on import")
+	flag.StringVar(&sortBy, "sort", "", "Sort the list by date, name, size or miniserver")
+	flag.BoolVar(&reverse, "reverse", false, "Reverse the order of the list")
+	flag.BoolVar(&yes, "yes", false, "Don't ask for confirmation before deleting")
+	flag.BoolVar(&trash, "trash", false, "List the snapshots in the trash")
+	flag.BoolVar(&sizes, "sizes", false, "List the storage used by each snapshot and in total")
+	flag.StringVar(&comment, "comment", "", "Set the comment on upload or edit")
+	flag.Var(&tags, "tag", "Set a tag as key=value on upload or edit - can be repeated, key= removes it")
+	flag.StringVar(&expireAfter, "expire-after", "", "Delete the uploaded snapshot automatically after this long, eg 7d")
+	flag.StringVar(&expireAt, "expire-at", "", "Delete the uploaded snapshot automatically at this date, eg 2015-06-01")
+	flag.StringVar(&expires, "expires", "24h", "How long the URLs made by share work for, eg 7d")
+	flag.StringVar(&toProfile, "to-profile", "", "Profile in the config file of the account to transfer to")
+	flag.StringVar(&listen, "listen", ":8080", "Address for serve, or daemon if set, to listen on")
+	flag.DurationVar(&minAge, "min-age", 24*time.Hour, "Only gc chunks or fsck snapshots older than this as newer ones may be uploading")
 	flag.IntVar(&flagsConfig.ChunkSize, "chunk-size", chunkSizeDefault, "Size of the chunks to make")
 	flag.StringVar(&flagsConfig.User, "user", "", "Memstore user name, eg myaccaa1.admin")
 	flag.StringVar(&flagsConfig.Password, "password", "", "Memstore password")
+	flag.IntVar(&flagsConfig.CompressLevel, "compress-level", 0, "Gzip compression level 1-9 for raw uploads (default 6)")
+	flag.IntVar(&flagsConfig.CompressThreads, "compress-threads", 0, "Number of threads to compress raw uploads with (default number of CPUs)")
+	flag.BoolVar(&flagsConfig.Decompress, "decompress", false, "Decompress raw images on download, writing them sparsely")
+	flag.BoolVar(&flagsConfig.SoftDelete, "soft-delete", false, "Move deleted snapshots to the trash so they can be undeleted")
+	flag.StringVar(&flagsConfig.CacheFile, "cache-file", "", "File to cache snapshot details in to speed up listing, eg ~/.snapshot-manager.cache")
+	flag.StringVar(&flagsConfig.KeyFile, "key-file", "", "Encrypt uploads and decrypt downloads with the key in this file")
+	flag.StringVar(&flagsConfig.Passphrase, "passphrase", "", "Encrypt uploads and decrypt downloads with a key made from this passphrase - insecure as other users can see it, use $"+passphraseEnv+" or the config file")
+	flag.StringVar(&flagsConfig.SignKey, "sign-key", "", "PEM file with an ed25519 private key to sign uploads and edits with")
+	flag.StringVar(&flagsConfig.TempUrlKey, "temp-url-key", "", "Temp-URL-Key to set on the account for share (default read or make one)")
+	flag.StringVar(&flagsConfig.BwLimit, "bwlimit", "", "Bandwidth limit for uploads and downloads, eg 10M or a schedule like '08:00,5M 18:00,off'")
+	flag.StringVar(&flagsConfig.Token, "token", "", "Bearer token clients of serve must use")
+	flag.StringVar(&flagsConfig.MetricsFile, "metrics-file", "", "Write Prometheus metrics to this file for the node_exporter textfile collector")
+	flag.StringVar(&flagsConfig.StateFile, "state-file", "", "File the daemon keeps the state of its schedules in (default ~/"+stateFileName+")")
+	flag.StringVar(&flagsConfig.TrashExpire, "trash-expire", "", "How long deleted snapshots stay in the trash, eg 7d (default 30d)")
 	flag.StringVar(&flagsConfig.AuthUrl, "auth-url", "https://auth.storage.memset.com/v1.0", "Swift Auth URL - default is for Memstore")
 }
 
@@ -65,6 +205,67 @@ func overrideConfigFileWithFlags() {
 	if flagsConfig.ChunkSize != chunkSizeDefault {
 		Config.ChunkSize = flagsConfig.ChunkSize
 	}
+	if flagsConfig.CompressLevel != 0 {
+		Config.CompressLevel = flagsConfig.CompressLevel
+	}
+	if flagsConfig.CompressThreads != 0 {
+		Config.CompressThreads = flagsConfig.CompressThreads
+	}
+	if flagsConfig.Decompress {
+		Config.Decompress = flagsConfig.Decompress
+	}
+	if flagsConfig.SoftDelete {
+		Config.SoftDelete = flagsConfig.SoftDelete
+	}
+	if flagsConfig.TrashExpire != "" {
+		Config.TrashExpire = flagsConfig.TrashExpire
+	}
+	if flagsConfig.CacheFile != "" {
+		Config.CacheFile = flagsConfig.CacheFile
+	}
+	if strings.HasPrefix(Config.CacheFile, "~/") {
+		Config.CacheFile = path.Join(homeDir, Config.CacheFile[2:])
+	}
+	if flagsConfig.KeyFile != "" {
+		Config.KeyFile = flagsConfig.KeyFile
+	}
+	if strings.HasPrefix(Config.KeyFile, "~/") {
+		Config.KeyFile = path.Join(homeDir, Config.KeyFile[2:])
+	}
+	if passphrase := os.Getenv(passphraseEnv); passphrase != "" {
+		Config.Passphrase = passphrase
+	}
+	if flagsConfig.Passphrase != "" {
+		log.Printf("Warning: -passphrase can be seen by other users - use $%s or the config file instead", passphraseEnv)
+		Config.Passphrase = flagsConfig.Passphrase
+	}
+	if flagsConfig.SignKey != "" {
+		Config.SignKey = flagsConfig.SignKey
+	}
+	if flagsConfig.TempUrlKey != "" {
+		Config.TempUrlKey = flagsConfig.TempUrlKey
+	}
+	if flagsConfig.BwLimit != "" {
+		Config.BwLimit = flagsConfig.BwLimit
+	}
+	if flagsConfig.Token != "" {
+		Config.Token = flagsConfig.Token
+	}
+	if strings.HasPrefix(Config.SignKey, "~/") {
+		Config.SignKey = path.Join(homeDir, Config.SignKey[2:])
+	}
+	if flagsConfig.StateFile != "" {
+		Config.StateFile = flagsConfig.StateFile
+	}
+	if strings.HasPrefix(Config.StateFile, "~/") {
+		Config.StateFile = path.Join(homeDir, Config.StateFile[2:])
+	}
+	if flagsConfig.MetricsFile != "" {
+		Config.MetricsFile = flagsConfig.MetricsFile
+	}
+	if strings.HasPrefix(Config.MetricsFile, "~/") {
+		Config.MetricsFile = path.Join(homeDir, Config.MetricsFile[2:])
+	}
 }
 
 // Find the config directory
@@ -90,17 +291,61 @@ func configHome() string {
 
 // List the snapshots available
 func listSnapshots() {
-	snapshots, err := sm.List()
+	list := sm.List
+	if trash {
+		list = sm.ListTrash
+	}
+	snapshots, err := list()
 	if err != nil {
 		log.Fatalf("List failed: %v", err)
 	}
+	snapshots = snapshot.Select(snapshots, selectFilters()...)
+	if sortBy != "" || reverse {
+		if sortBy == "" {
+			sortBy = "name"
+		}
+		err = snapshot.Sort(snapshots, sortBy, reverse)
+		if err != nil {
+			log.Fatalf("Bad -sort: %v", err)
+		}
+	}
 	if len(snapshots) == 0 {
 		fmt.Println("No snapshots found")
 		return
 	}
+	var storedSize, diskSize int64
 	for _, snapshot := range snapshots {
+		if sizes {
+			err = snapshot.ReadSizes()
+			if err != nil {
+				log.Fatalf("Failed to read sizes: %v", err)
+			}
+			storedSize += snapshot.StoredSize
+			diskSize += snapshot.DiskSize
+		}
 		snapshot.List()
 	}
+	if sizes {
+		fmt.Printf("Total\n")
+		fmt.Printf("  Snapshots  - %d\n", len(snapshots))
+		fmt.Printf("  StoredSize - %d\n", storedSize)
+		fmt.Printf("  DiskSize   - %d\n", diskSize)
+		if storedSize != 0 {
+			fmt.Printf("  Ratio      - %.2f\n", float64(diskSize)/float64(storedSize))
+		}
+	}
+}
+
+// Show a snapshot in full detail
+func infoSnapshot(name string) {
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+	err = s.Info()
+	if err != nil {
+		log.Fatalf("Failed to show snapshot: %v", err)
+	}
 }
 
 // Download a snapshot
@@ -118,6 +363,7 @@ func downloadSnaphot(name string) {
 // Upload a snapshot
 func uploadSnaphot(name, file string) {
 	s := sm.NewSnapshotForUpload(name, file)
+	setUploadMetadata(s)
 	log.Printf("Uploading snapshot")
 	err := s.Put(file)
 	if err != nil {
@@ -125,15 +371,389 @@ func uploadSnaphot(name, file string) {
 	}
 }
 
-// Delete a snapshot
-func deleteSnaphot(name string) {
+// Import a snapshot from a URL
+func importSnapshot(name, url string) {
+	s := sm.NewSnapshotForImport(name, url)
+	setUploadMetadata(s)
+	log.Printf("Importing snapshot from %q", url)
+	err := s.Import(url, imageType)
+	if err != nil {
+		log.Fatalf("Failed to import snapshot: %v", err)
+	}
+}
+
+// setUploadMetadata sets the expiry, comment, miniserver and tags of
+// a snapshot about to be uploaded from the flags
+func setUploadMetadata(s *snapshot.Snapshot) {
+	switch {
+	case expireAfter != "" && expireAt != "":
+		fatalf("Can't use -expire-after and -expire-at together")
+	case expireAfter != "":
+		d, err := snapshot.ParseDuration(expireAfter)
+		if err != nil {
+			log.Fatalf("Bad -expire-after: %v", err)
+		}
+		s.ExpireAt = time.Now().Add(d)
+	case expireAt != "":
+		t, err := snapshot.ParseDate(expireAt)
+		if err != nil {
+			log.Fatalf("Bad -expire-at: %v", err)
+		}
+		s.ExpireAt = t
+	}
+	if !s.ExpireAt.IsZero() && s.ExpireAt.Before(time.Now()) {
+		log.Fatalf("Expiry time %v is in the past", s.ExpireAt)
+	}
+	setMetadata(s)
+}
+
+// selectFilters makes the filters from the flags used to select
+// snapshots
+func selectFilters() []snapshot.Filter {
+	var filters []snapshot.Filter
+	if match != "" {
+		filter, err := snapshot.MatchName(match)
+		if err != nil {
+			log.Fatalf("Bad -match: %v", err)
+		}
+		filters = append(filters, filter)
+	}
+	if before != "" {
+		t, err := snapshot.ParseDate(before)
+		if err != nil {
+			log.Fatalf("Bad -before: %v", err)
+		}
+		filters = append(filters, snapshot.Before(t))
+	}
+	if since != "" {
+		t, err := snapshot.ParseDate(since)
+		if err != nil {
+			log.Fatalf("Bad -since: %v", err)
+		}
+		filters = append(filters, snapshot.Since(t))
+	}
+	if until != "" {
+		t, err := snapshot.ParseDate(until)
+		if err != nil {
+			log.Fatalf("Bad -until: %v", err)
+		}
+		if len(until) == len("2006-01-02") {
+			// include the whole of the day
+			t = t.Add(24*time.Hour - time.Nanosecond)
+		}
+		filters = append(filters, snapshot.Until(t))
+	}
+	if miniserver != "" {
+		filters = append(filters, snapshot.OfMiniserver(miniserver))
+	}
+	if imageType != "" {
+		filters = append(filters, snapshot.OfType(imageType))
+	}
+	if broken {
+		filters = append(filters, snapshot.IsBroken)
+	}
+	return filters
+}
+
+// confirm asks the user a yes/no question returning true for yes
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Delete the snapshots named or selected by the flags
+func deleteSnaphots(names []string) {
+	filters := selectFilters()
+	if len(names) == 0 && len(filters) == 0 {
+		fatalf("Snapshot names or -match, -before, -since, -until, -miniserver, -type or -broken required for delete")
+	}
+	var snapshots []*snapshot.Snapshot
+	if len(names) == 0 {
+		var err error
+		snapshots, err = sm.List()
+		if err != nil {
+			log.Fatalf("List failed: %v", err)
+		}
+	}
+	for _, name := range names {
+		s, err := sm.ReadSnapshot(name)
+		if err != nil {
+			log.Fatalf("Failed to read snapshot: %v", err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	snapshots = snapshot.Select(snapshots, filters...)
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots selected")
+		return
+	}
+
+	// Confirm unless deleting a single snapshot by name
+	if !yes && (len(filters) != 0 || len(snapshots) > 1) {
+		fmt.Printf("These %d snapshots will be deleted\n", len(snapshots))
+		for _, s := range snapshots {
+			fmt.Printf("  %-40s %12d bytes  %s\n", s.Name, s.DiskSize, s.Date.Format(snapshot.DirectoryDate))
+		}
+		if !confirm("Delete them?") {
+			fmt.Println("Not deleting")
+			return
+		}
+	}
+
+	failed := 0
+	for _, s := range snapshots {
+		err := s.Delete()
+		if err != nil {
+			failed++
+			log.Printf("Failed to delete snapshot %q: %v", s.Name, err)
+		}
+	}
+	if failed != 0 {
+		log.Fatalf("Failed to delete %d snapshots", failed)
+	}
+}
+
+// Edit the comment, miniserver and tags of a snapshot
+func editSnapshot(name string) {
+	if comment == "" && miniserver == "" && len(tags) == 0 {
+		fatalf("One of -comment, -miniserver or -tag required for edit")
+	}
 	s, err := sm.ReadSnapshot(name)
 	if err != nil {
 		log.Fatalf("Failed to read snapshot: %v", err)
 	}
-	err = s.Delete()
+	setMetadata(s)
+	err = s.Update()
 	if err != nil {
-		log.Fatalf("Failed to delete snapshot: %v", err)
+		log.Fatalf("Failed to edit snapshot: %v", err)
+	}
+}
+
+// Set or remove the expiry of a snapshot
+func expireSnapshot(name, when string) {
+	var expireAt time.Time
+	if strings.ToLower(when) != "off" {
+		d, err := snapshot.ParseDuration(when)
+		if err != nil {
+			t, dateErr := snapshot.ParseDate(when)
+			if dateErr != nil {
+				log.Fatalf("Bad expiry %q - use a duration like 7d, a date or off", when)
+			}
+			expireAt = t
+		} else {
+			expireAt = time.Now().Add(d)
+		}
+	}
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+	err = s.SetExpiry(expireAt)
+	if err != nil {
+		log.Fatalf("Failed to set expiry: %v", err)
+	}
+	if expireAt.IsZero() {
+		fmt.Printf("Snapshot %q will not expire\n", name)
+	} else {
+		fmt.Printf("Snapshot %q will expire at %v\n", name, expireAt)
+	}
+}
+
+// Make temporary URLs to download a snapshot without credentials
+func shareSnapshot(name string) {
+	d, err := snapshot.ParseDuration(expires)
+	if err != nil {
+		log.Fatalf("Bad -expires: %v", err)
+	}
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+	key, err := sm.TempUrlKey(Config.TempUrlKey)
+	if err != nil {
+		log.Fatalf("Failed to share snapshot: %v", err)
+	}
+	urls, err := s.Share(key, d)
+	if err != nil {
+		log.Fatalf("Failed to share snapshot: %v", err)
+	}
+	fmt.Printf("Snapshot %q can be downloaded until %v with\n\n", name, urls[0].Expires)
+	for _, u := range urls {
+		fmt.Printf("curl -o '%s' '%s'\n", u.Leaf, u.Url)
+	}
+	if !s.ExpireAt.IsZero() && s.ExpireAt.Before(urls[0].Expires) {
+		fmt.Printf("\nNote that the snapshot expires sooner at %v\n", s.ExpireAt)
+	}
+	if s.Encryption != "" {
+		fmt.Printf("\nNote that the image is encrypted and needs the key to decrypt it\n")
+	}
+}
+
+// Copy a snapshot to the account in a profile
+func transferSnapshot(name string) {
+	if toProfile == "" {
+		fatalf("Need -to-profile for transfer")
+	}
+	profile, ok := Config.Profiles[toProfile]
+	if !ok {
+		log.Fatalf("Profile %q not found in config file %q", toProfile, configFile)
+	}
+	if profile.User == "" || profile.Password == "" {
+		log.Fatalf(`Profile %q needs "user" and "password"`, toProfile)
+	}
+	if profile.AuthUrl == "" {
+		profile.AuthUrl = Config.AuthUrl
+	}
+	c := newConnection(profile.User, profile.Password, profile.AuthUrl)
+	err := c.Authenticate()
+	if err != nil {
+		log.Fatalf("Failed to log in to profile %q: %v", toProfile, err)
+	}
+	dst := &snapshot.Manager{
+		Swift:           c,
+		ChunkSize:       sm.ChunkSize,
+		Container:       profile.Container,
+		DeleteThreads:   sm.DeleteThreads,
+		TransferThreads: sm.TransferThreads,
+		BwLimit:         sm.BwLimit,
+	}
+	dst.Init()
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+	err = s.Transfer(dst)
+	if err != nil {
+		log.Fatalf("Failed to transfer snapshot: %v", err)
+	}
+	fmt.Printf("Snapshot %q transferred to %q and verified OK\n", name, toProfile)
+}
+
+// Restore a snapshot from the trash
+func undeleteSnapshot(name string) {
+	s, err := sm.FindTrash(name)
+	if err != nil {
+		log.Fatalf("Failed to find snapshot: %v", err)
+	}
+	err = s.Undelete()
+	if err != nil {
+		log.Fatalf("Failed to undelete snapshot: %v", err)
+	}
+}
+
+// Verify a snapshot
+func verifySnapshot(name string) {
+	var publicKey ed25519.PublicKey
+	if signature {
+		if pubkey == "" {
+			fatalf("Need -pubkey to check the signature")
+		}
+		var err error
+		publicKey, err = snapshot.LoadPublicKey(pubkey)
+		if err != nil {
+			log.Fatalf("Bad public key: %v", err)
+		}
+	}
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		log.Fatalf("Failed to read snapshot: %v", err)
+	}
+	results := s.Verify(deep)
+	if signature {
+		result := snapshot.VerifyResult{Check: "signature"}
+		result.Err = s.VerifySignature(publicKey)
+		results = append(results, result)
+	}
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if snapshot.VerifyFailed(results) {
+		log.Fatalf("Snapshot %q failed verification", name)
+	}
+	fmt.Printf("Snapshot %q verified OK\n", name)
+}
+
+// Check snapshots for problems and optionally repair them
+func fsckSnapshots(names []string) {
+	var snapshots []*snapshot.Snapshot
+	if len(names) == 0 {
+		var err error
+		snapshots, err = sm.List()
+		if err != nil {
+			log.Fatalf("List failed: %v", err)
+		}
+	}
+	for _, name := range names {
+		s, err := sm.ReadSnapshot(name)
+		if err != nil {
+			log.Fatalf("Failed to read snapshot: %v", err)
+		}
+		snapshots = append(snapshots, s)
+	}
+	problems := 0
+	for _, s := range snapshots {
+		report, err := s.Fsck(minAge)
+		if err != nil {
+			log.Fatalf("Failed to check snapshot %q: %v", s.Name, err)
+		}
+		if report.Recent {
+			fmt.Printf("%s - skipped as modified less than %v ago\n", s.Name, minAge)
+			continue
+		}
+		if report.OK() {
+			fmt.Printf("%s - OK\n", s.Name)
+			continue
+		}
+		problems++
+		fmt.Printf("%s - %d problems\n", s.Name, len(report.Problems))
+		for _, problem := range report.Problems {
+			fmt.Printf("  %v\n", problem)
+		}
+		if repair || remove {
+			err = report.Repair(remove, dryRun)
+			if err != nil {
+				log.Fatalf("Failed to repair snapshot %q: %v", s.Name, err)
+			}
+		}
+	}
+	if problems == 0 {
+		return
+	}
+	if !repair && !remove {
+		log.Fatalf("%d snapshots with problems - use -repair and/or -delete to fix", problems)
+	}
+	log.Fatalf("%d snapshots had problems", problems)
+}
+
+// Find chunks not referenced by any manifest and optionally delete them
+func gcChunks() {
+	report, err := sm.Gc(minAge)
+	if err != nil {
+		log.Fatalf("Gc failed: %v", err)
+	}
+	for _, object := range report.Unreferenced {
+		fmt.Printf("%s - %d bytes\n", object.Name, object.Bytes)
+	}
+	fmt.Printf("%d chunks referenced\n", report.Referenced)
+	if report.Skipped != 0 {
+		fmt.Printf("%d unreferenced chunks newer than %v skipped\n", report.Skipped, minAge)
+	}
+	fmt.Printf("%d unreferenced chunks using %d bytes\n", len(report.Unreferenced), report.Bytes)
+	if len(report.Unreferenced) == 0 {
+		return
+	}
+	if !remove {
+		fmt.Printf("Use -delete to reclaim %d bytes\n", report.Bytes)
+		return
+	}
+	err = report.Delete(sm, dryRun)
+	if err != nil {
+		log.Fatalf("Failed to delete unreferenced chunks: %v", err)
 	}
 }
 
@@ -148,9 +768,21 @@ Manage snapshots in Memset Memstore
 Commands
 
   list             - lists the snapshots
+  info name        - shows the snapshot in full detail
   download name    - downloads the snapshot
   upload name file - uploads a disk image as a snapshot
-  delete name      - deletes the snapshot
+  import name url  - uploads a disk image from a URL as a snapshot
+  delete [name...] - deletes the snapshots named or selected
+  undelete name    - restores the snapshot from the trash
+  edit name        - changes the comment, miniserver or tags
+  expire name when - deletes the snapshot after eg 7d, at a date or off
+  share name       - makes URLs to download the snapshot without credentials
+  transfer name    - copies the snapshot to the account in -to-profile
+  verify name      - checks the snapshot is intact
+  fsck [name...]   - finds and repairs broken snapshots
+  gc               - finds chunks not used by any snapshot
+  serve            - serves a REST API on -listen
+  daemon           - runs the schedules in the config file
   types            - available snapshot types
 
 Full options:
@@ -158,6 +790,16 @@ Full options:
 	flag.PrintDefaults()
 }
 
+// newConnection makes a v1 auth connection to Memstore, used for the
+// main account and the profiles so they are set up the same
+func newConnection(user, password, authUrl string) *swift.Connection {
+	return &swift.Connection{
+		UserName: user,
+		ApiKey:   password,
+		AuthUrl:  authUrl,
+	}
+}
+
 // Exit with the message
 func fatalf(message string, args ...interface{}) {
 	syntaxError()
@@ -203,6 +845,11 @@ func main() {
 	case "list":
 		checkArgs(0)
 		fn = listSnapshots
+	case "info":
+		checkArgs(1)
+		fn = func() {
+			infoSnapshot(args[0])
+		}
 	case "download":
 		checkArgs(1)
 		fn = func() {
@@ -213,11 +860,58 @@ func main() {
 		fn = func() {
 			uploadSnaphot(args[0], args[1])
 		}
+	case "import":
+		checkArgs(2)
+		fn = func() {
+			importSnapshot(args[0], args[1])
+		}
 	case "delete":
+		fn = func() {
+			deleteSnaphots(args)
+		}
+	case "edit":
+		checkArgs(1)
+		fn = func() {
+			editSnapshot(args[0])
+		}
+	case "expire":
+		checkArgs(2)
+		fn = func() {
+			expireSnapshot(args[0], args[1])
+		}
+	case "share":
+		checkArgs(1)
+		fn = func() {
+			shareSnapshot(args[0])
+		}
+	case "transfer":
 		checkArgs(1)
 		fn = func() {
-			deleteSnaphot(args[0])
+			transferSnapshot(args[0])
+		}
+	case "undelete":
+		checkArgs(1)
+		fn = func() {
+			undeleteSnapshot(args[0])
+		}
+	case "verify":
+		checkArgs(1)
+		fn = func() {
+			verifySnapshot(args[0])
+		}
+	case "fsck":
+		fn = func() {
+			fsckSnapshots(args)
 		}
+	case "gc":
+		checkArgs(0)
+		fn = gcChunks
+	case "serve":
+		checkArgs(0)
+		fn = serveApi
+	case "daemon":
+		checkArgs(0)
+		fn = runDaemon
 	case "types":
 		checkArgs(0)
 		needsConnection = false
@@ -229,12 +923,7 @@ func main() {
 		fatalf("Command %q not understood", command)
 	}
 
-	// Create a v1 auth connection
-	c := swift.Connection{
-		UserName: Config.User,
-		ApiKey:   Config.Password,
-		AuthUrl:  Config.AuthUrl,
-	}
+	c := newConnection(Config.User, Config.Password, Config.AuthUrl)
 
 	// Check connection if required
 	if needsConnection {
@@ -251,8 +940,37 @@ func main() {
 
 	// Create the manager
 	sm = &snapshot.Manager{
-		Swift:     &c,
-		ChunkSize: Config.ChunkSize,
+		Swift:           c,
+		ChunkSize:       Config.ChunkSize,
+		CompressLevel:   Config.CompressLevel,
+		CompressThreads: Config.CompressThreads,
+		Decompress:      Config.Decompress,
+		SoftDelete:      Config.SoftDelete,
+		CacheFile:       Config.CacheFile,
+		KeyFile:         Config.KeyFile,
+		Passphrase:      Config.Passphrase,
+		MetricsFile:     Config.MetricsFile,
+	}
+	if sm.KeyFile != "" && sm.Passphrase != "" {
+		fatalf("Use only one of -key-file and -passphrase or $" + passphraseEnv)
+	}
+	if Config.SignKey != "" {
+		sm.SignKey, err = snapshot.LoadSigningKey(Config.SignKey)
+		if err != nil {
+			log.Fatalf("Bad signing key: %v", err)
+		}
+	}
+	if Config.TrashExpire != "" {
+		sm.TrashExpire, err = snapshot.ParseDuration(Config.TrashExpire)
+		if err != nil {
+			log.Fatalf("Bad trash expiry: %v", err)
+		}
+	}
+	if Config.BwLimit != "" {
+		sm.BwLimit, err = snapshot.ParseBwLimit(Config.BwLimit)
+		if err != nil {
+			log.Fatalf("Bad -bwlimit: %v", err)
+		}
 	}
 	sm.Init()
 
@@ -0,0 +1,609 @@
+// REST API server for the snapshot manager
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/memset/snapshot-manager/snapshot"
+)
+
+const (
+	// Number of finished jobs to remember
+	jobsKept = 100
+	// How often to list the snapshots to keep their metrics up to date
+	metricsRefresh = 5 * time.Minute
+)
+
+// snapshotJSON is a snapshot as returned by the API
+type snapshotJSON struct {
+	Name       string            `json:"name"`
+	Comment    string            `json:"comment,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Date       time.Time         `json:"date"`
+	Broken     bool              `json:"broken"`
+	Miniserver string            `json:"miniserver,omitempty"`
+	ImageType  string            `json:"image_type,omitempty"`
+	ImageLeaf  string            `json:"image_leaf,omitempty"`
+	Md5        string            `json:"md5,omitempty"`
+	Sha256     string            `json:"sha256,omitempty"`
+	DiskSize   int64             `json:"disk_size,omitempty"`
+	ExpireAt   *time.Time        `json:"expire_at,omitempty"`
+	Encryption string            `json:"encryption,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	ReadMe     string            `json:"readme,omitempty"`
+}
+
+// newSnapshotJSON makes the API view of s including the README.txt
+// if readme is set
+func newSnapshotJSON(s *snapshot.Snapshot, readme bool) *snapshotJSON {
+	j := &snapshotJSON{
+		Name:       s.Name,
+		Comment:    s.Comment,
+		Path:       s.Path,
+		Date:       s.Date,
+		Broken:     s.Broken,
+		Miniserver: s.Miniserver,
+		ImageType:  s.ImageType,
+		ImageLeaf:  s.ImageLeaf,
+		Md5:        s.Md5,
+		Sha256:     s.Sha256,
+		DiskSize:   s.DiskSize,
+		Encryption: s.Encryption,
+		Tags:       s.Tags,
+	}
+	if !s.ExpireAt.IsZero() {
+		expireAt := s.ExpireAt
+		j.ExpireAt = &expireAt
+	}
+	if readme {
+		j.ReadMe = s.ReadMe
+	}
+	return j
+}
+
+// verifyJSON is the result of a verify check as returned by the API
+type verifyJSON struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// newVerifyJSON makes the API view of the verify results
+func newVerifyJSON(results []snapshot.VerifyResult) []verifyJSON {
+	var out []verifyJSON
+	for _, r := range results {
+		j := verifyJSON{Check: r.Check, Status: "pass"}
+		if r.Err != nil {
+			j.Error = r.Err.Error()
+			j.Status = "fail"
+			if r.Skipped {
+				j.Status = "skip"
+			}
+		}
+		out = append(out, j)
+	}
+	return out
+}
+
+// Job is a long running operation run by the API
+type Job struct {
+	Id       string      `json:"id"`
+	Op       string      `json:"op"`
+	Snapshot string      `json:"snapshot"`
+	Status   string      `json:"status"` // running, done or failed
+	Error    string      `json:"error,omitempty"`
+	Result   interface{} `json:"result,omitempty"`
+	Started  time.Time   `json:"started"`
+	Finished *time.Time  `json:"finished,omitempty"`
+}
+
+// Jobs keeps track of the jobs run by the API
+type Jobs struct {
+	mu    sync.Mutex
+	next  int
+	jobs  map[string]*Job
+	order []string        // ids in the order the jobs were started
+	busy  map[string]bool // snapshots reserved for a single job
+}
+
+// NewJobs makes an empty Jobs
+func NewJobs() *Jobs {
+	return &Jobs{
+		jobs: map[string]*Job{},
+		busy: map[string]bool{},
+	}
+}
+
+// reserve marks the snapshot name as in use by a job, returning false
+// if it already is.  Call release when the job has finished.
+func (js *Jobs) reserve(name string) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.busy[name] {
+		return false
+	}
+	js.busy[name] = true
+	return true
+}
+
+// release marks the snapshot name reserved by reserve as free
+func (js *Jobs) release(name string) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	delete(js.busy, name)
+}
+
+// add makes a new running job for op on the snapshot name
+func (js *Jobs) add(op, name string) *Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	js.next++
+	job := &Job{
+		Id:       strconv.Itoa(js.next),
+		Op:       op,
+		Snapshot: name,
+		Status:   "running",
+		Started:  time.Now(),
+	}
+	js.jobs[job.Id] = job
+	js.order = append(js.order, job.Id)
+	js.prune()
+	return job
+}
+
+// prune forgets the oldest finished jobs if there are too many - call
+// with the lock held
+func (js *Jobs) prune() {
+	finished := 0
+	for _, id := range js.order {
+		if js.jobs[id].Finished != nil {
+			finished++
+		}
+	}
+	var order []string
+	for _, id := range js.order {
+		if finished > jobsKept && js.jobs[id].Finished != nil {
+			delete(js.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	js.order = order
+}
+
+// finish marks the job as finished with the result or err
+func (js *Jobs) finish(job *Job, result interface{}, err error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	now := time.Now()
+	job.Finished = &now
+	job.Result = result
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		log.Printf("Job %s %s %q failed: %v", job.Id, job.Op, job.Snapshot, err)
+	} else {
+		job.Status = "done"
+		log.Printf("Job %s %s %q done", job.Id, job.Op, job.Snapshot)
+	}
+}
+
+// Run runs fn as a job for op on the snapshot name, returning the
+// job when it has finished
+func (js *Jobs) Run(op, name string, fn func() (interface{}, error)) Job {
+	job := js.add(op, name)
+	result, err := fn()
+	js.finish(job, result, err)
+	return js.Get(job.Id)
+}
+
+// Start runs fn as a job for op on the snapshot name in the
+// background, returning the job as it is now
+func (js *Jobs) Start(op, name string, fn func() (interface{}, error)) Job {
+	job := js.add(op, name)
+	go func() {
+		result, err := fn()
+		js.finish(job, result, err)
+	}()
+	return js.Get(job.Id)
+}
+
+// Get returns a copy of the job with id or a job with an empty Id if
+// not found
+func (js *Jobs) Get(id string) Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	job, ok := js.jobs[id]
+	if !ok {
+		return Job{}
+	}
+	return *job
+}
+
+// List returns copies of all the jobs, oldest first
+func (js *Jobs) List() []Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	jobs := make([]Job, 0, len(js.order))
+	for _, id := range js.order {
+		jobs = append(jobs, *js.jobs[id])
+	}
+	return jobs
+}
+
+// Server serves the REST API for a Manager
+type Server struct {
+	sm    *snapshot.Manager
+	token string
+	jobs  *Jobs
+	mux   *http.ServeMux
+}
+
+// NewServer makes a Server for sm which needs token to use it
+func NewServer(sm *snapshot.Manager, token string) *Server {
+	srv := &Server{
+		sm:    sm,
+		token: token,
+		jobs:  NewJobs(),
+		mux:   http.NewServeMux(),
+	}
+	srv.mux.HandleFunc("/v1/snapshots", srv.handleSnapshots)
+	srv.mux.HandleFunc("/v1/snapshots/", srv.handleSnapshot)
+	srv.mux.HandleFunc("/v1/jobs", srv.handleJobs)
+	srv.mux.HandleFunc("/v1/jobs/", srv.handleJob)
+	return srv
+}
+
+// Handle adds an extra handler which doesn't need authentication,
+// eg for metrics
+func (srv *Server) Handle(pattern string, handler http.Handler) {
+	srv.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP checks the bearer token then serves the request
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, pattern := srv.mux.Handler(r); !strings.HasPrefix(pattern, "/v1/") {
+		h.ServeHTTP(w, r)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(srv.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="snapshot-manager"`)
+		writeError(w, http.StatusUnauthorized, errors.New("bad or missing bearer token"))
+		return
+	}
+	srv.mux.ServeHTTP(w, r)
+}
+
+// writeJSON writes v as the JSON response with status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+// writeError writes err as the JSON response with status
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// methodNotAllowed writes the error for a request with the wrong
+// method
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+// GET /v1/snapshots lists the snapshots
+//
+// They can be selected and sorted with the query parameters match,
+// miniserver, type, sort and reverse which work like the flags of the
+// same name.
+func (srv *Server) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	q := r.URL.Query()
+	var filters []snapshot.Filter
+	if match := q.Get("match"); match != "" {
+		filter, err := snapshot.MatchName(match)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		filters = append(filters, filter)
+	}
+	if miniserver := q.Get("miniserver"); miniserver != "" {
+		filters = append(filters, snapshot.OfMiniserver(miniserver))
+	}
+	if imageType := q.Get("type"); imageType != "" {
+		filters = append(filters, snapshot.OfType(imageType))
+	}
+	snapshots, err := srv.sm.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	snapshots = snapshot.Select(snapshots, filters...)
+	if sortBy := q.Get("sort"); sortBy != "" {
+		err = snapshot.Sort(snapshots, sortBy, q.Get("reverse") == "true")
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	out := []*snapshotJSON{}
+	for _, s := range snapshots {
+		out = append(out, newSnapshotJSON(s, false))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// Serves requests for a single snapshot
+//
+//	GET    /v1/snapshots/name          - shows the snapshot
+//	PUT    /v1/snapshots/name?file=... - uploads the body as the snapshot
+//	DELETE /v1/snapshots/name          - deletes the snapshot as a job
+//	GET    /v1/snapshots/name/download - downloads the image
+//	POST   /v1/snapshots/name/verify   - verifies the snapshot as a job
+func (srv *Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/snapshots/")
+	action := ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+	if name == "" {
+		writeError(w, http.StatusNotFound, errors.New("no snapshot name"))
+		return
+	}
+	switch action {
+	case "":
+		switch r.Method {
+		case "GET":
+			srv.getSnapshot(w, name)
+		case "PUT":
+			srv.putSnapshot(w, r, name)
+		case "DELETE":
+			srv.deleteSnapshot(w, name)
+		default:
+			methodNotAllowed(w, "GET", "PUT", "DELETE")
+		}
+	case "download":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		srv.downloadSnapshot(w, name)
+	case "verify":
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		srv.verifySnapshot(w, r, name)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %q", action))
+	}
+}
+
+// readSnapshot reads the snapshot name writing an error if it
+// couldn't be read or doesn't exist
+func (srv *Server) readSnapshot(w http.ResponseWriter, name string) *snapshot.Snapshot {
+	s := srv.sm.NewSnapshot(name)
+	ok, err := s.Exists()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("snapshot %q not found", name))
+		return nil
+	}
+	s, err = srv.sm.ReadSnapshot(name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return nil
+	}
+	return s
+}
+
+// Shows a snapshot in full
+func (srv *Server) getSnapshot(w http.ResponseWriter, name string) {
+	s := srv.readSnapshot(w, name)
+	if s == nil {
+		return
+	}
+	writeJSON(w, http.StatusOK, newSnapshotJSON(s, true))
+}
+
+// Uploads the body of the request as a snapshot
+//
+// The query parameter file is the name of the image which sets its
+// type, eg "image.tar".  The comment, miniserver and tag (as
+// key=value and repeatable) parameters set those on the snapshot.
+func (srv *Server) putSnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+	file := q.Get("file")
+	if file == "" {
+		writeError(w, http.StatusBadRequest, errors.New("need file parameter with the name of the image, eg image.tar"))
+		return
+	}
+	s := srv.sm.NewSnapshotForUpload(name, file)
+	if comment := q.Get("comment"); comment != "" {
+		s.Comment = comment
+	}
+	if miniserver := q.Get("miniserver"); miniserver != "" {
+		s.Miniserver = miniserver
+	}
+	for _, tag := range q["tag"] {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("tag %q should be key=value", tag))
+			return
+		}
+		err := s.SetTag(kv[0], kv[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	// Only upload a snapshot once at a time, and check it doesn't
+	// exist first, so a failed upload can be cleaned up safely
+	if !srv.jobs.reserve(name) {
+		writeError(w, http.StatusConflict, fmt.Errorf("snapshot %q is already being uploaded", name))
+		return
+	}
+	defer srv.jobs.release(name)
+	ok, err := s.Exists()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("snapshot %q already exists", name))
+		return
+	}
+	job := srv.jobs.Run("upload", name, func() (interface{}, error) {
+		err := s.PutStream(r.Body, r.ContentLength)
+		if err != nil {
+			cleanUp(s)
+			return nil, err
+		}
+		return newSnapshotJSON(s, false), nil
+	})
+	status := http.StatusCreated
+	if job.Status != "done" {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, job)
+}
+
+// Deletes a snapshot in the background
+func (srv *Server) deleteSnapshot(w http.ResponseWriter, name string) {
+	s := srv.readSnapshot(w, name)
+	if s == nil {
+		return
+	}
+	job := srv.jobs.Start("delete", name, func() (interface{}, error) {
+		return nil, s.Delete()
+	})
+	writeJob(w, job)
+}
+
+// Verifies a snapshot in the background - use deep=true to read the
+// whole image
+func (srv *Server) verifySnapshot(w http.ResponseWriter, r *http.Request, name string) {
+	s := srv.readSnapshot(w, name)
+	if s == nil {
+		return
+	}
+	deep := r.URL.Query().Get("deep") == "true"
+	job := srv.jobs.Start("verify", name, func() (interface{}, error) {
+		results := s.Verify(deep)
+		if snapshot.VerifyFailed(results) {
+			return newVerifyJSON(results), fmt.Errorf("snapshot %q failed verification", name)
+		}
+		return newVerifyJSON(results), nil
+	})
+	writeJob(w, job)
+}
+
+// writeJob writes the response for a job started in the background
+func writeJob(w http.ResponseWriter, job Job) {
+	w.Header().Set("Location", "/v1/jobs/"+job.Id)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// Streams the image of the snapshot as the response
+func (srv *Server) downloadSnapshot(w http.ResponseWriter, name string) {
+	s := srv.readSnapshot(w, name)
+	if s == nil {
+		return
+	}
+	if s.Broken {
+		writeError(w, http.StatusConflict, fmt.Errorf("snapshot %q is broken", name))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", s.DownloadName()))
+	err := s.Download(w)
+	if err != nil {
+		// Too late to send an error so break the connection
+		log.Printf("Download of %q failed: %v", name, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// GET /v1/jobs lists the jobs
+func (srv *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, srv.jobs.List())
+}
+
+// GET /v1/jobs/id shows the status of a job
+func (srv *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+	job := srv.jobs.Get(id)
+	if job.Id == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("job %q not found", id))
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// Serve the REST API
+func serveApi() {
+	if Config.Token == "" {
+		fatalf("Need -token for serve")
+	}
+	srv := NewServer(sm, Config.Token)
+	srv.Handle("/metrics", sm.Metrics)
+	go refreshMetrics(nil)
+	log.Printf("Serving the API on %s", listen)
+	err := http.ListenAndServe(listen, srv)
+	if err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
+
+// refreshMetrics lists the snapshots every metricsRefresh so the
+// metrics about them stay up to date, until stop is closed
+func refreshMetrics(stop <-chan struct{}) {
+	ticker := time.NewTicker(metricsRefresh)
+	defer ticker.Stop()
+	for {
+		_, err := sm.List()
+		if err != nil {
+			log.Printf("Failed to list snapshots for metrics: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
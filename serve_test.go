@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/memset/snapshot-manager/snapshot"
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
+)
+
+const testToken = "s3cret"
+
+// newTestServer returns an API server in front of an in memory Swift
+// server, both of which are stopped at the end of the test
+func newTestServer(t *testing.T) (*httptest.Server, *snapshot.Manager, *swifttest.SwiftServer) {
+	swiftServer, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatalf("failed to start swift server: %v", err)
+	}
+	t.Cleanup(swiftServer.Close)
+	c := &swift.Connection{
+		UserName: "swifttest",
+		ApiKey:   "swifttest",
+		AuthUrl:  swiftServer.AuthURL,
+	}
+	err = c.Authenticate()
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	sm := &snapshot.Manager{
+		Swift:     c,
+		ChunkSize: 100000,
+	}
+	sm.Init()
+	srv := NewServer(sm, testToken)
+	srv.Handle("/metrics", sm.Metrics)
+	server := httptest.NewServer(srv)
+	t.Cleanup(server.Close)
+	return server, sm, swiftServer
+}
+
+// testImage makes an image of n bytes
+func testImage(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+// do makes an authenticated request returning the response and its
+// body
+func do(t *testing.T, method, url string, body io.Reader) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := body.(*bytes.Reader); ok {
+		req.ContentLength = int64(b.Len())
+	}
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	return send(t, req)
+}
+
+// send sends req returning the response and its body
+func send(t *testing.T, req *http.Request) (*http.Response, []byte) {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// decode decodes the JSON in data into v
+func decode(t *testing.T, data []byte, v interface{}) {
+	err := json.Unmarshal(data, v)
+	if err != nil {
+		t.Fatalf("bad JSON %q: %v", data, err)
+	}
+}
+
+// waitJob polls the job with id until it has finished
+func waitJob(t *testing.T, server *httptest.Server, id string) Job {
+	for i := 0; i < 500; i++ {
+		resp, data := do(t, "GET", server.URL+"/v1/jobs/"+id, nil)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("job %s: status %d: %s", id, resp.StatusCode, data)
+		}
+		var job Job
+		decode(t, data, &job)
+		if job.Status != "running" {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't finish", id)
+	return Job{}
+}
+
+func TestServeAuth(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	for _, auth := range []string{"", testToken, "Bearer wrong", "Bearer " + testToken + "x", "Basic " + testToken} {
+		req, err := http.NewRequest("GET", server.URL+"/v1/snapshots", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, _ := send(t, req)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%q: status %d want 401", auth, resp.StatusCode)
+		}
+		if resp.Header.Get("WWW-Authenticate") == "" {
+			t.Errorf("%q: no WWW-Authenticate", auth)
+		}
+	}
+
+	resp, data := do(t, "GET", server.URL+"/v1/snapshots", nil)
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(data)) != "[]" {
+		t.Errorf("list: status %d %q", resp.StatusCode, data)
+	}
+
+	// The metrics don't need the token
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("metrics: status %d", resp.StatusCode)
+	}
+}
+
+func TestServeErrors(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/v1/snapshots/missing", http.StatusNotFound},
+		{"DELETE", "/v1/snapshots/missing", http.StatusNotFound},
+		{"GET", "/v1/snapshots/missing/download", http.StatusNotFound},
+		{"POST", "/v1/snapshots/missing/verify", http.StatusNotFound},
+		{"GET", "/v1/snapshots/missing/unknown", http.StatusNotFound},
+		{"GET", "/v1/snapshots/", http.StatusNotFound},
+		{"GET", "/v1/jobs/99", http.StatusNotFound},
+		{"POST", "/v1/snapshots", http.StatusMethodNotAllowed},
+		{"POST", "/v1/snapshots/name", http.StatusMethodNotAllowed},
+		{"PUT", "/v1/snapshots/name/download", http.StatusMethodNotAllowed},
+		{"GET", "/v1/snapshots/name/verify", http.StatusMethodNotAllowed},
+		{"DELETE", "/v1/jobs", http.StatusMethodNotAllowed},
+		{"POST", "/v1/jobs/1", http.StatusMethodNotAllowed},
+		{"PUT", "/v1/snapshots/name", http.StatusBadRequest},
+		{"PUT", "/v1/snapshots/name?file=image.tar&tag=novalue", http.StatusBadRequest},
+		{"GET", "/v1/snapshots?match=[", http.StatusBadRequest},
+		{"GET", "/v1/snapshots?sort=nonsense", http.StatusBadRequest},
+	} {
+		resp, data := do(t, test.method, server.URL+test.path, nil)
+		if resp.StatusCode != test.status {
+			t.Errorf("%s %s: status %d want %d: %s", test.method, test.path, resp.StatusCode, test.status, data)
+			continue
+		}
+		var body map[string]string
+		decode(t, data, &body)
+		if body["error"] == "" {
+			t.Errorf("%s %s: no error in %q", test.method, test.path, data)
+		}
+		if test.status == http.StatusMethodNotAllowed && resp.Header.Get("Allow") == "" {
+			t.Errorf("%s %s: no Allow header", test.method, test.path)
+		}
+	}
+}
+
+func TestServeSnapshot(t *testing.T) {
+	server, _, _ := newTestServer(t)
+	image := testImage(250000)
+	url := server.URL + "/v1/snapshots/snap"
+
+	// Upload it
+	resp, data := do(t, "PUT", url+"?file=image.tar&comment=hello&tag=env=prod", bytes.NewReader(image))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("upload: status %d: %s", resp.StatusCode, data)
+	}
+	var job Job
+	decode(t, data, &job)
+	if job.Op != "upload" || job.Status != "done" || job.Snapshot != "snap" || job.Finished == nil {
+		t.Errorf("upload job %+v", job)
+	}
+
+	// Uploading it again conflicts
+	resp, data = do(t, "PUT", url+"?file=image.tar", bytes.NewReader(image))
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("upload again: status %d want 409: %s", resp.StatusCode, data)
+	}
+
+	// Show it and list it
+	resp, data = do(t, "GET", url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("get: status %d: %s", resp.StatusCode, data)
+	}
+	var s snapshotJSON
+	decode(t, data, &s)
+	if s.Name != "snap" || s.Comment != "hello" || s.Tags["env"] != "prod" || s.ImageLeaf != "image.tar" || s.ReadMe == "" {
+		t.Errorf("get: %+v", s)
+	}
+	resp, data = do(t, "GET", server.URL+"/v1/snapshots?match=sn*", nil)
+	var list []snapshotJSON
+	decode(t, data, &list)
+	if resp.StatusCode != http.StatusOK || len(list) != 1 || list[0].Name != "snap" || list[0].ReadMe != "" {
+		t.Errorf("list: status %d %+v", resp.StatusCode, list)
+	}
+
+	// Download it
+	resp, data = do(t, "GET", url+"/download", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("download: status %d", resp.StatusCode)
+	}
+	if !bytes.Equal(data, image) {
+		t.Errorf("downloaded %d bytes which differ from the %d uploaded", len(data), len(image))
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="image.tar"` {
+		t.Errorf("download: Content-Disposition %q", got)
+	}
+
+	// Verify it
+	resp, data = do(t, "POST", url+"/verify?deep=true", nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("verify: status %d: %s", resp.StatusCode, data)
+	}
+	decode(t, data, &job)
+	if resp.Header.Get("Location") != "/v1/jobs/"+job.Id {
+		t.Errorf("verify: Location %q", resp.Header.Get("Location"))
+	}
+	job = waitJob(t, server, job.Id)
+	if job.Status != "done" || job.Result == nil {
+		t.Errorf("verify job %+v", job)
+	}
+
+	// Delete it
+	resp, data = do(t, "DELETE", url, nil)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("delete: status %d: %s", resp.StatusCode, data)
+	}
+	decode(t, data, &job)
+	job = waitJob(t, server, job.Id)
+	if job.Status != "done" {
+		t.Errorf("delete job %+v", job)
+	}
+	resp, _ = do(t, "GET", url, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("get after delete: status %d want 404", resp.StatusCode)
+	}
+
+	// All the jobs are listed
+	resp, data = do(t, "GET", server.URL+"/v1/jobs", nil)
+	var jobs []Job
+	decode(t, data, &jobs)
+	if resp.StatusCode != http.StatusOK || len(jobs) != 3 {
+		t.Errorf("jobs: status %d %+v", resp.StatusCode, jobs)
+	}
+}
+
+func TestServeConcurrentUpload(t *testing.T) {
+	server, sm, _ := newTestServer(t)
+	image := testImage(250000)
+	url := server.URL + "/v1/snapshots/snap?file=image.tar"
+
+	// Start an upload which stalls after the first chunk
+	in, out := io.Pipe()
+	req, err := http.NewRequest("PUT", url, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(image))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	done := make(chan int)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}()
+	_, err = out.Write(image[:150000])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		_, data := do(t, "GET", server.URL+"/v1/jobs", nil)
+		var jobs []Job
+		decode(t, data, &jobs)
+		if len(jobs) == 1 && jobs[0].Status == "running" {
+			break
+		}
+		if i > 500 {
+			t.Fatalf("upload didn't start: %+v", jobs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A second upload of the same name is refused and leaves the
+	// first alone
+	resp, data := do(t, "PUT", url, bytes.NewReader(image))
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(data), "already being uploaded") {
+		t.Errorf("second upload: status %d want 409: %s", resp.StatusCode, data)
+	}
+
+	_, err = out.Write(image[150000:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = out.Close()
+	if status := <-done; status != http.StatusCreated {
+		t.Fatalf("first upload: status %d want 201", status)
+	}
+	s, err := sm.ReadSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = s.Download(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), image) {
+		t.Errorf("uploaded %d bytes which differ from the %d sent", buf.Len(), len(image))
+	}
+
+	// Once finished the name is no longer reserved but it exists
+	resp, data = do(t, "PUT", url, bytes.NewReader(image))
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(data), "already exists") {
+		t.Errorf("upload after: status %d want 409: %s", resp.StatusCode, data)
+	}
+}
+
+func TestServeUploadFails(t *testing.T) {
+	server, sm, swiftServer := newTestServer(t)
+	// Fail the upload of the second chunk
+	chunk := "/v1/AUTH_swifttest/" + sm.Container + "/snap/image.part/00000002"
+	swiftServer.SetOverride(chunk, func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	resp, data := do(t, "PUT", server.URL+"/v1/snapshots/snap?file=image.tar", bytes.NewReader(testImage(250000)))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("upload: status %d want 500: %s", resp.StatusCode, data)
+	}
+	var job Job
+	decode(t, data, &job)
+	if job.Status != "failed" || job.Error == "" {
+		t.Errorf("upload job %+v", job)
+	}
+	names, err := sm.Swift.ObjectNamesAll(sm.Container, &swift.ObjectsOpts{Prefix: "snap/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("failed upload left %q", names)
+	}
+}
@@ -0,0 +1,191 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BwSlot is the bandwidth limit from a time of day onwards
+type BwSlot struct {
+	Minute    int   // minutes after midnight the slot starts
+	Bandwidth int64 // bytes per second or 0 for no limit
+}
+
+// BwTimetable is a bandwidth limit which varies with the time of day
+type BwTimetable []BwSlot
+
+// ParseBwLimit parses a bandwidth limit
+//
+// This is either a single limit like "10M", or a schedule of times
+// and limits like "08:00,5M 18:00,off" where each limit applies from
+// its time until the next.  Limits are in bytes per second with an
+// optional K, M or G suffix and "off" means no limit.
+func ParseBwLimit(limit string) (BwTimetable, error) {
+	var t BwTimetable
+	fields := strings.Fields(limit)
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		bandwidth, err := parseBandwidth(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return BwTimetable{{Bandwidth: bandwidth}}, nil
+	}
+	for _, field := range fields {
+		tokens := strings.Split(field, ",")
+		if len(tokens) != 2 {
+			return nil, fmt.Errorf("bad bandwidth limit %q - expecting HH:MM,limit", field)
+		}
+		when, err := time.Parse("15:04", tokens[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad time in bandwidth limit %q", field)
+		}
+		bandwidth, err := parseBandwidth(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		t = append(t, BwSlot{
+			Minute:    when.Hour()*60 + when.Minute(),
+			Bandwidth: bandwidth,
+		})
+	}
+	if len(t) == 0 {
+		return nil, fmt.Errorf("empty bandwidth limit")
+	}
+	sort.SliceStable(t, func(i, j int) bool { return t[i].Minute < t[j].Minute })
+	return t, nil
+}
+
+// parseBandwidth parses a limit like "10M" or "off"
+func parseBandwidth(bandwidth string) (int64, error) {
+	if strings.ToLower(bandwidth) == "off" {
+		return 0, nil
+	}
+	if bandwidth == "" {
+		return 0, fmt.Errorf("empty bandwidth - use eg 10M or off")
+	}
+	number := bandwidth
+	multiplier := int64(1)
+	switch suffix := strings.ToUpper(bandwidth[len(bandwidth)-1:]); suffix {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		number = bandwidth[:len(bandwidth)-1]
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("bad bandwidth %q - use eg 10M or off", bandwidth)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// LimitAt returns the bandwidth limit in force at now or 0 for none
+func (t BwTimetable) LimitAt(now time.Time) int64 {
+	if len(t) == 0 {
+		return 0
+	}
+	minute := now.Hour()*60 + now.Minute()
+	// Before the first slot the last one from the day before applies
+	limit := t[len(t)-1].Bandwidth
+	for _, slot := range t {
+		if slot.Minute > minute {
+			break
+		}
+		limit = slot.Bandwidth
+	}
+	return limit
+}
+
+// bwLimiter is a token bucket shared by all the transfers of a
+// Manager
+type bwLimiter struct {
+	mu        sync.Mutex
+	timetable BwTimetable
+	tokens    float64   // bytes which can be sent now - may be negative
+	last      time.Time // when tokens was last topped up
+}
+
+// newBwLimiter makes a bwLimiter from the timetable
+func newBwLimiter(timetable BwTimetable) *bwLimiter {
+	return &bwLimiter{
+		timetable: timetable,
+		last:      time.Now(),
+	}
+}
+
+// wait sleeps until n bytes may be transferred
+func (l *bwLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	rate := float64(l.timetable.LimitAt(now))
+	if rate == 0 {
+		l.tokens = 0
+		l.last = now
+		l.mu.Unlock()
+		return
+	}
+	// Top up the bucket allowing bursts of up to a second
+	l.tokens += now.Sub(l.last).Seconds() * rate
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var sleep time.Duration
+	if l.tokens < 0 {
+		sleep = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(sleep)
+}
+
+// bwReader limits the bandwidth of an io.Reader
+type bwReader struct {
+	in io.Reader
+	l  *bwLimiter
+}
+
+// Read from the reader then wait for the bandwidth to be available
+func (r *bwReader) Read(p []byte) (n int, err error) {
+	n, err = r.in.Read(p)
+	r.l.wait(n)
+	return n, err
+}
+
+// bwWriter limits the bandwidth of an io.Writer
+type bwWriter struct {
+	out io.Writer
+	l   *bwLimiter
+}
+
+// Write to the writer then wait for the bandwidth to be available
+func (w *bwWriter) Write(p []byte) (n int, err error) {
+	n, err = w.out.Write(p)
+	w.l.wait(n)
+	return n, err
+}
+
+// limitReader returns in limited to the bandwidth of the Manager
+func (sm *Manager) limitReader(in io.Reader) io.Reader {
+	if sm.bwLimiter == nil {
+		return in
+	}
+	return &bwReader{in: in, l: sm.bwLimiter}
+}
+
+// limitWriter returns out limited to the bandwidth of the Manager
+func (sm *Manager) limitWriter(out io.Writer) io.Writer {
+	if sm.bwLimiter == nil {
+		return out
+	}
+	return &bwWriter{out: out, l: sm.bwLimiter}
+}
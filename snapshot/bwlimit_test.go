@@ -0,0 +1,96 @@
+package snapshot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBwLimit(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want BwTimetable
+	}{
+		{"10", BwTimetable{{0, 10}}},
+		{"1.5K", BwTimetable{{0, 1536}}},
+		{"10M", BwTimetable{{0, 10 << 20}}},
+		{"10m", BwTimetable{{0, 10 << 20}}},
+		{"2G", BwTimetable{{0, 2 << 30}}},
+		{"off", BwTimetable{{0, 0}}},
+		{"OFF", BwTimetable{{0, 0}}},
+		{"08:00,5M 18:00,off", BwTimetable{{8 * 60, 5 << 20}, {18 * 60, 0}}},
+		{"18:00,off 08:00,5M", BwTimetable{{8 * 60, 5 << 20}, {18 * 60, 0}}},
+		{"  00:00,1K\t23:59,2K ", BwTimetable{{0, 1 << 10}, {23*60 + 59, 2 << 10}}},
+		{"12:30,100", BwTimetable{{12*60 + 30, 100}}},
+	} {
+		got, err := ParseBwLimit(test.in)
+		if err != nil {
+			t.Errorf("%q: failed: %v", test.in, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestParseBwLimitErrors(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want string
+	}{
+		{"", "empty bandwidth limit"},
+		{"   ", "empty bandwidth limit"},
+		{"fast", "bad bandwidth"},
+		{"10X", "bad bandwidth"},
+		{"M", "bad bandwidth"},
+		{"0", "bad bandwidth"},
+		{"-5M", "bad bandwidth"},
+		{"10M 20M", "expecting HH:MM,limit"},
+		{"08:00", "bad bandwidth"},
+		{"08:00,5M,6M", "expecting HH:MM,limit"},
+		{"25:00,5M", "bad time"},
+		{"8am,5M", "bad time"},
+		{"08:00,", "empty bandwidth"},
+		{"08:00,5M 18:00,lots", "bad bandwidth"},
+	} {
+		got, err := ParseBwLimit(test.in)
+		if err == nil {
+			t.Errorf("%q: parsed as %v", test.in, got)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error %q doesn't contain %q", test.in, err, test.want)
+		}
+	}
+}
+
+func TestLimitAt(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2015, 6, 1, hour, minute, 30, 0, time.UTC)
+	}
+	timetable := BwTimetable{{8 * 60, 5 << 20}, {12 * 60, 1 << 20}, {18 * 60, 0}}
+	for _, test := range []struct {
+		timetable BwTimetable
+		now       time.Time
+		want      int64
+	}{
+		{nil, at(12, 0), 0},
+		{BwTimetable{{0, 100}}, at(0, 0), 100},
+		{BwTimetable{{0, 100}}, at(23, 59), 100},
+		// Before the first slot the last one of the day before applies
+		{timetable, at(0, 0), 0},
+		{timetable, at(7, 59), 0},
+		{BwTimetable{{8 * 60, 5 << 20}, {18 * 60, 1 << 20}}, at(3, 0), 1 << 20},
+		{BwTimetable{{8 * 60, 5 << 20}}, at(7, 0), 5 << 20},
+		// Each slot applies from its start until the next
+		{timetable, at(8, 0), 5 << 20},
+		{timetable, at(11, 59), 5 << 20},
+		{timetable, at(12, 0), 1 << 20},
+		{timetable, at(17, 59), 1 << 20},
+		{timetable, at(18, 0), 0},
+		{timetable, at(23, 59), 0},
+	} {
+		got := test.timetable.LimitAt(test.now)
+		if got != test.want {
+			t.Errorf("%v at %s: got %d want %d", test.timetable, test.now.Format("15:04"), got, test.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// readmeCache caches the README.txt of snapshots on local disk so
+// they don't need to be downloaded each time the snapshots are
+// listed.  Entries are keyed by the ETag and modification time of
+// the README.txt so they are refreshed when it changes.
+type readmeCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]readmeCacheEntry // by README.txt object name
+	seen    map[string]bool             // entries used since load
+	dirty   bool
+}
+
+// readmeCacheEntry is a cached README.txt
+type readmeCacheEntry struct {
+	Key      string    // ETag and modification time of the README.txt
+	ReadMe   string    // contents of the README.txt
+	ExpireAt time.Time // expiry of the README.txt
+}
+
+// newReadmeCache loads the cache from path
+//
+// If the cache can't be read it starts empty.
+func newReadmeCache(path string) *readmeCache {
+	c := &readmeCache{
+		path:    path,
+		entries: map[string]readmeCacheEntry{},
+		seen:    map[string]bool{},
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Couldn't read cache %q - ignoring: %v", path, err)
+		}
+		return c
+	}
+	err = json.Unmarshal(data, &c.entries)
+	if err != nil {
+		log.Printf("Couldn't parse cache %q - ignoring: %v", path, err)
+		c.entries = map[string]readmeCacheEntry{}
+	}
+	return c
+}
+
+// cacheKey makes the key for a README.txt
+func cacheKey(hash string, modified time.Time) string {
+	return hash + " " + modified.UTC().Format(time.RFC3339Nano)
+}
+
+// get returns the entry for name if it is in the cache with key
+func (c *readmeCache) get(name, key string) (entry readmeCacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok = c.entries[name]
+	if !ok || entry.Key != key {
+		return entry, false
+	}
+	c.seen[name] = true
+	return entry, true
+}
+
+// put stores entry for name in the cache
+func (c *readmeCache) put(name string, entry readmeCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[name] = entry
+	c.seen[name] = true
+	c.dirty = true
+}
+
+// save writes the cache back to disk if it has changed, dropping any
+// entries which weren't used if prune is set
+func (c *readmeCache) save(prune bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prune {
+		for name := range c.entries {
+			if !c.seen[name] {
+				delete(c.entries, name)
+				c.dirty = true
+			}
+		}
+	}
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(c.path, data, 0600)
+	if err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
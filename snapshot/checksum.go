@@ -0,0 +1,88 @@
+package snapshot
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/ncw/swift"
+)
+
+// Metadata header the SHA-256 of images and chunks is stored in
+const Sha256Header = "X-Object-Meta-Sha256"
+
+// imageHash is an io.Writer which calculates the MD5 and SHA-256 of
+// an image in one pass
+type imageHash struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+// newImageHash makes a new imageHash
+func newImageHash() *imageHash {
+	return &imageHash{
+		md5:    md5.New(),
+		sha256: sha256.New(),
+	}
+}
+
+// Write adds p to both the hashes
+func (h *imageHash) Write(p []byte) (int, error) {
+	_, _ = h.md5.Write(p)
+	_, _ = h.sha256.Write(p)
+	return len(p), nil
+}
+
+// Md5 returns the MD5 as a hex string
+func (h *imageHash) Md5() string {
+	return fmt.Sprintf("%x", h.md5.Sum(nil))
+}
+
+// Sha256 returns the SHA-256 as a hex string
+func (h *imageHash) Sha256() string {
+	return fmt.Sprintf("%x", h.sha256.Sum(nil))
+}
+
+// checkMd5 checks the MD5 of h matches the one in the README.txt
+func (s *Snapshot) checkMd5(h *imageHash) error {
+	if sum := h.Md5(); sum != strings.ToLower(s.Md5) {
+		return fmt.Errorf("MD5 of image %q doesn't match README.txt %q", sum, s.Md5)
+	}
+	return nil
+}
+
+// checkSha256 checks the SHA-256 of h matches the one in the
+// README.txt
+func (s *Snapshot) checkSha256(h *imageHash) error {
+	if sum := h.Sha256(); sum != strings.ToLower(s.Sha256) {
+		return fmt.Errorf("SHA-256 of image %q doesn't match README.txt %q", sum, s.Sha256)
+	}
+	return nil
+}
+
+// checkHashes checks the MD5 and SHA-256 of h match those in the
+// README.txt if it has them
+func (s *Snapshot) checkHashes(h *imageHash) error {
+	if s.Md5 != "" {
+		if err := s.checkMd5(h); err != nil {
+			return err
+		}
+	}
+	if s.Sha256 != "" {
+		if err := s.checkSha256(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sha256Headers returns h with the SHA-256 header added
+func sha256Headers(h swift.Headers, sum string) swift.Headers {
+	headers := swift.Headers{Sha256Header: sum}
+	for k, v := range h {
+		headers[k] = v
+	}
+	return headers
+}
@@ -0,0 +1,76 @@
+package snapshot
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ncw/swift"
+)
+
+// chunksPath returns the prefix the chunks of the image with leaf
+// name are stored under for the Type passed in
+func (s *Snapshot) chunksPath(leaf string, Type *Type) string {
+	return s.Name + "/" + leaf[:len(leaf)-len(Type.Suffix)] + ".part"
+}
+
+// parseManifest splits an X-Object-Manifest header into the
+// container and the prefix of the chunks
+func parseManifest(manifest string) (container, prefix string, err error) {
+	tokens := strings.SplitN(manifest, "/", 2)
+	if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return "", "", fmt.Errorf("bad manifest %q", manifest)
+	}
+	return tokens[0], tokens[1], nil
+}
+
+// Manifest reads the X-Object-Manifest of the snapshot image
+//
+// It returns the headers of the image object and the container and
+// prefix of the chunks.  If the image isn't a dynamic large object
+// then container and prefix will be empty.
+func (s *Snapshot) Manifest() (headers swift.Headers, container, prefix string, err error) {
+	if s.Path == "" {
+		return nil, "", "", fmt.Errorf("snapshot %q has no image", s.Name)
+	}
+	_, headers, err = s.Manager.Swift.Object(s.Manager.Container, s.Path)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("failed to read manifest %q: %v", s.Path, err)
+	}
+	manifest := headers["X-Object-Manifest"]
+	if manifest == "" {
+		return headers, "", "", nil
+	}
+	container, prefix, err = parseManifest(manifest)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return headers, container, prefix, nil
+}
+
+// Chunks lists all the chunks under prefix in container sorted by
+// name
+func (sm *Manager) Chunks(container, prefix string) ([]swift.Object, error) {
+	chunks, err := sm.Swift.ObjectsAll(container, &swift.ObjectsOpts{
+		Prefix: prefix,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks %q: %v", prefix, err)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i].Name < chunks[j].Name
+	})
+	return chunks, nil
+}
+
+// chunkNumber returns the number of the chunk from its name, eg
+// "name/image.part/00000001" is 1
+func chunkNumber(name string) (int, error) {
+	n, err := strconv.Atoi(path.Base(name))
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("bad chunk name %q", name)
+	}
+	return n, nil
+}
@@ -0,0 +1,178 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How far ahead Cron.Next looks before giving up
+const cronSearchYears = 5
+
+// Cron is a schedule of times in the style of a crontab entry
+type Cron struct {
+	minute, hour, dom, month, dow uint64 // bit set of the values allowed
+	domAny, dowAny                bool   // set if the field started with *
+}
+
+// Shorthands for common schedules
+var cronShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// ParseCron parses a schedule in crontab format
+//
+// This is five fields - minute, hour, day of month, month and day of
+// week (0-6 with 0 as Sunday) - each of which can be *, a number, a
+// range like 1-5 or a list of those like 1,15, optionally followed by
+// a step like */15.  As in Vixie cron, if both the day of month and
+// day of week are restricted then a day matching either runs,
+// otherwise it must match both, and a field starting with * like */2
+// doesn't count as restricted.  The shorthands @hourly, @daily,
+// @weekly and @monthly can also be used.
+func ParseCron(spec string) (*Cron, error) {
+	if shorthand, ok := cronShorthands[strings.ToLower(strings.TrimSpace(spec))]; ok {
+		spec = shorthand
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("bad schedule %q - expecting 5 fields like \"30 2 * * *\"", spec)
+	}
+	c := &Cron{
+		domAny: strings.HasPrefix(fields[2], "*"),
+		dowAny: strings.HasPrefix(fields[4], "*"),
+	}
+	var err error
+	for _, field := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		*field.bits, err = parseCronField(fields[0], field.min, field.max)
+		if err != nil {
+			return nil, fmt.Errorf("bad schedule %q: %v", spec, err)
+		}
+		fields = fields[1:]
+	}
+	// Sunday can be 0 or 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses one field of a crontab entry whose values
+// run from min to max
+func parseCronField(field string, min, max int) (bits uint64, err error) {
+	for _, item := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(item, "/"); i >= 0 {
+			step, err = strconv.Atoi(item[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", item)
+			}
+			item = item[:i]
+		}
+		start, end := min, max
+		switch {
+		case item == "*":
+		case strings.Contains(item, "-"):
+			tokens := strings.SplitN(item, "-", 2)
+			start, err = strconv.Atoi(tokens[0])
+			if err != nil {
+				return 0, fmt.Errorf("bad range %q", item)
+			}
+			end, err = strconv.Atoi(tokens[1])
+			if err != nil {
+				return 0, fmt.Errorf("bad range %q", item)
+			}
+		default:
+			start, err = strconv.Atoi(item)
+			if err != nil {
+				return 0, fmt.Errorf("bad value %q", item)
+			}
+			end = start
+			if step != 1 {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q out of range %d-%d", item, min, max)
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// hasBit returns whether value is in the bit set bits
+func hasBit(bits uint64, value int) bool {
+	return bits&(1<<uint(value)) != 0
+}
+
+// matchDay returns whether the day of t matches the schedule
+func (c *Cron) matchDay(t time.Time) bool {
+	dom := hasBit(c.dom, t.Day())
+	dow := hasBit(c.dow, int(t.Weekday()))
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// firstTime returns the first of the two times with the wall clock
+// time of t if it is repeated because the clocks went back
+func firstTime(t time.Time) time.Time {
+	_, offset := t.Zone()
+	_, offsetBefore := t.Add(-12 * time.Hour).Zone()
+	if offsetBefore <= offset {
+		return t
+	}
+	earlier := t.Add(-time.Duration(offsetBefore-offset) * time.Second)
+	if earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute() {
+		return earlier
+	}
+	return t
+}
+
+// Next returns the first time in the schedule after t or a zero time
+// if there isn't one, eg for the 31st of February
+//
+// The schedule is in the wall clock time of t's location.  A time
+// skipped when the clocks go forward runs just after the change and
+// a time repeated when the clocks go back runs once.
+func (c *Cron) Next(t time.Time) time.Time {
+	// Search in wall clock time held as UTC so there are no gaps
+	wall := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, time.UTC)
+	end := wall.AddDate(cronSearchYears, 0, 0)
+	for wall.Before(end) {
+		switch {
+		case !hasBit(c.month, int(wall.Month())):
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !c.matchDay(wall):
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !hasBit(c.hour, wall.Hour()):
+			wall = wall.Truncate(time.Hour).Add(time.Hour)
+		case !hasBit(c.minute, wall.Minute()):
+			wall = wall.Add(time.Minute)
+		default:
+			next := firstTime(time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, t.Location()))
+			if next.After(t) {
+				return next
+			}
+			wall = wall.Add(time.Minute)
+		}
+	}
+	return time.Time{}
+}
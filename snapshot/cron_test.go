@@ -0,0 +1,149 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+)
+
+const cronTestFormat = "2006-01-02 15:04 MST"
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1- * * * *",
+		"a * * * *",
+		"1,,2 * * * *",
+	} {
+		_, err := ParseCron(spec)
+		if err == nil {
+			t.Errorf("ParseCron(%q) didn't return an error", spec)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	for _, test := range []struct {
+		spec string
+		from string
+		want string // empty for no next time
+	}{
+		{"30 2 * * *", "2026-01-01 00:00 UTC", "2026-01-01 02:30 UTC"},
+		{"30 2 * * *", "2026-01-01 02:30 UTC", "2026-01-02 02:30 UTC"},
+		{"30 2 * * *", "2025-12-31 23:59 UTC", "2026-01-01 02:30 UTC"},
+		{"@hourly", "2026-01-01 10:59 UTC", "2026-01-01 11:00 UTC"},
+		{"@daily", "2026-01-01 10:59 UTC", "2026-01-02 00:00 UTC"},
+		{"@weekly", "2026-02-02 10:00 UTC", "2026-02-08 00:00 UTC"},
+		{"@monthly", "2026-01-31 12:00 UTC", "2026-02-01 00:00 UTC"},
+		{"0 9-17/4 * * 1-5", "2026-02-06 18:00 UTC", "2026-02-09 09:00 UTC"},
+		{"0 9-17/4 * * 1-5", "2026-02-09 09:00 UTC", "2026-02-09 13:00 UTC"},
+		{"0 0 1,15 * *", "2026-02-02 00:00 UTC", "2026-02-15 00:00 UTC"},
+
+		// Day of month or day of week when both are restricted
+		{"0 0 10 * 5", "2026-02-07 00:00 UTC", "2026-02-10 00:00 UTC"},
+		{"0 0 10 * 5", "2026-02-10 00:00 UTC", "2026-02-13 00:00 UTC"},
+
+		// A field starting with * isn't restricted
+		{"0 0 1 * */2", "2026-02-02 00:00 UTC", "2026-03-01 00:00 UTC"},
+		{"0 0 */2 * 1", "2026-02-03 00:00 UTC", "2026-02-09 00:00 UTC"},
+		{"0 0 */10 * *", "2026-02-02 00:00 UTC", "2026-02-11 00:00 UTC"},
+
+		// Sunday as 7
+		{"0 0 * * 7", "2026-02-02 00:00 UTC", "2026-02-08 00:00 UTC"},
+		{"0 0 * * 5-7", "2026-02-07 00:00 UTC", "2026-02-08 00:00 UTC"},
+		{"0 0 * * 5-7", "2026-02-08 00:00 UTC", "2026-02-13 00:00 UTC"},
+
+		// A step on a single value runs to the end of the range
+		{"5/15 * * * *", "2026-01-01 10:00 UTC", "2026-01-01 10:05 UTC"},
+		{"5/15 * * * *", "2026-01-01 10:05 UTC", "2026-01-01 10:20 UTC"},
+		{"5/15 * * * *", "2026-01-01 10:50 UTC", "2026-01-01 11:05 UTC"},
+
+		// Dates which are rare or impossible
+		{"0 0 29 2 *", "2026-03-01 00:00 UTC", "2028-02-29 00:00 UTC"},
+		{"0 0 31 * *", "2026-04-01 00:00 UTC", "2026-05-31 00:00 UTC"},
+		{"0 0 30 2 *", "2026-01-01 00:00 UTC", ""},
+		{"0 0 31 4,6,9,11 *", "2026-01-01 00:00 UTC", ""},
+	} {
+		c, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", test.spec, err)
+		}
+		from, err := time.Parse(cronTestFormat, test.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := c.Next(from)
+		got := ""
+		if !next.IsZero() {
+			got = next.Format(cronTestFormat)
+		}
+		if got != test.want {
+			t.Errorf("%q.Next(%s) = %q want %q", test.spec, test.from, got, test.want)
+		}
+	}
+}
+
+func TestCronNextDST(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	for _, test := range []struct {
+		spec string
+		from string
+		want []string
+	}{
+		// Clocks go forward at 01:00 GMT on 29 March 2026
+		{"30 1 * * *", "2026-03-28 12:00 GMT", []string{
+			"2026-03-29 02:30 BST",
+			"2026-03-30 01:30 BST",
+		}},
+		{"0 * * * *", "2026-03-29 00:30 GMT", []string{
+			"2026-03-29 02:00 BST",
+			"2026-03-29 03:00 BST",
+		}},
+		{"0 3 * * *", "2026-03-28 12:00 GMT", []string{
+			"2026-03-29 03:00 BST",
+			"2026-03-30 03:00 BST",
+		}},
+		// Clocks go back at 02:00 BST on 25 October 2026
+		{"30 1 * * *", "2026-10-24 12:00 BST", []string{
+			"2026-10-25 01:30 BST",
+			"2026-10-26 01:30 GMT",
+		}},
+		{"0 * * * *", "2026-10-25 00:30 BST", []string{
+			"2026-10-25 01:00 BST",
+			"2026-10-25 02:00 GMT",
+			"2026-10-25 03:00 GMT",
+		}},
+	} {
+		c, err := ParseCron(test.spec)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", test.spec, err)
+		}
+		from, err := time.ParseInLocation(cronTestFormat, test.from, london)
+		if err != nil {
+			t.Fatal(err)
+		}
+		next := from
+		for i, want := range test.want {
+			next = c.Next(next)
+			if got := next.Format(cronTestFormat); got != want {
+				t.Errorf("%q from %s run %d = %q want %q", test.spec, test.from, i+1, got, want)
+				break
+			}
+		}
+	}
+}
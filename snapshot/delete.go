@@ -0,0 +1,236 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+const (
+	// Number of times to try deleting each object
+	deleteRetries = 3
+	// Max objects per bulk delete if the cluster doesn't say
+	bulkDeleteMaxDefault = 1000
+	// Max failures to show in an ObjectsError
+	objectsErrorShown = 10
+)
+
+// How long to wait before the first retry of a delete, doubling for
+// each retry after that
+var deleteRetryDelay = time.Second
+
+// ObjectsError is returned when an operation on many objects fails
+// for some of them
+type ObjectsError struct {
+	Op     string           // the operation, eg "delete"
+	Errors map[string]error // object name to error
+}
+
+// Error summarises the objects which failed
+func (e *ObjectsError) Error() string {
+	names := errorNames(e.Errors)
+	out := fmt.Sprintf("failed to %s %d objects:", e.Op, len(names))
+	for i, name := range names {
+		if i >= objectsErrorShown {
+			out += fmt.Sprintf(" and %d more", len(names)-i)
+			break
+		}
+		out += fmt.Sprintf(" %q: %v;", name, e.Errors[name])
+	}
+	return strings.TrimSuffix(out, ";")
+}
+
+// bulkDeleteSize returns the max number of objects to delete in a
+// bulk delete or 0 if the cluster doesn't support it
+func (sm *Manager) bulkDeleteSize() int {
+	sm.bulkDeleteOnce.Do(func() {
+		info, err := sm.Swift.QueryInfo()
+		if err != nil {
+			log.Printf("Couldn't read cluster info - not using bulk delete: %v", err)
+			return
+		}
+		if !info.SupportsBulkDelete() {
+			return
+		}
+		sm.bulkDeleteMax = bulkDeleteMaxDefault
+		if bulk, ok := info["bulk_delete"].(map[string]interface{}); ok {
+			if max, ok := bulk["max_deletes_per_request"].(float64); ok && max >= 1 {
+				sm.bulkDeleteMax = int(max)
+			}
+		}
+	})
+	return sm.bulkDeleteMax
+}
+
+// DeleteObjects deletes the objects passed in from the container
+//
+// It uses bulk delete if the cluster supports it or deletes the
+// objects in parallel otherwise, retrying any which fail with a
+// backoff.  If the cluster refuses the bulk delete the objects are
+// deleted in parallel instead.  Objects which are already gone count
+// as deleted.  If any objects couldn't be deleted it returns an
+// *ObjectsError.
+func (sm *Manager) DeleteObjects(objects []swift.Object) error {
+	var names []string
+	for _, object := range objects {
+		if !object.PseudoDirectory {
+			names = append(names, object.Name)
+		}
+	}
+	var errs map[string]error
+	max := sm.bulkDeleteSize()
+	delay := deleteRetryDelay
+	for try := 1; try <= deleteRetries && len(names) > 0; try++ {
+		if try > 1 {
+			log.Printf("Retrying delete of %d objects in %v (try %d/%d)", len(names), delay, try, deleteRetries)
+			sm.Metrics.retry("delete", len(names))
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if max > 0 {
+			var refused error
+			errs, refused = sm.bulkDelete(names, max)
+			if refused != nil {
+				log.Printf("Bulk delete refused - deleting objects in parallel: %v", refused)
+				max = 0
+				names = errorNames(errs)
+			}
+		}
+		if max == 0 {
+			errs = sm.parallelDelete(names)
+		}
+		names = errorNames(errs)
+	}
+	if len(errs) != 0 {
+		return &ObjectsError{Op: "delete", Errors: errs}
+	}
+	return nil
+}
+
+// errorNames returns the names of the objects in errs sorted
+func errorNames(errs map[string]error) []string {
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// bulkDeleteRefused returns whether err means the cluster won't do
+// bulk deletes for us at all
+func bulkDeleteRefused(err error) bool {
+	if swiftErr, ok := err.(*swift.Error); ok {
+		switch swiftErr.StatusCode {
+		case http.StatusForbidden, http.StatusNotFound, http.StatusNotImplemented:
+			return true
+		}
+	}
+	return false
+}
+
+// bulkDelete deletes names in batches of max objects, returning the
+// errors for the objects which couldn't be deleted
+//
+// If the cluster refuses the bulk delete it stops and returns the
+// error as refused with the objects not yet deleted in errs.
+func (sm *Manager) bulkDelete(names []string, max int) (errs map[string]error, refused error) {
+	errs = map[string]error{}
+	prefix := "/" + sm.Container + "/"
+	for len(names) > 0 {
+		batch := names
+		if len(batch) > max {
+			batch = batch[:max]
+		}
+		names = names[len(batch):]
+		log.Printf("Bulk deleting %d objects from %q to %q", len(batch), batch[0], batch[len(batch)-1])
+		result, err := sm.Swift.BulkDelete(sm.Container, batch)
+		for path, objectErr := range result.Errors {
+			if objectErr == swift.ObjectNotFound {
+				continue
+			}
+			if unescaped, err := url.PathUnescape(path); err == nil {
+				path = unescaped
+			}
+			errs[strings.TrimPrefix(path, prefix)] = objectErr
+		}
+		// The error only applies to the whole batch if no objects
+		// were reported individually
+		if err == nil || len(result.Errors) != 0 {
+			continue
+		}
+		if bulkDeleteRefused(err) {
+			for _, name := range batch {
+				errs[name] = err
+			}
+			for _, name := range names {
+				errs[name] = err
+			}
+			return errs, err
+		}
+		for _, name := range batch {
+			errs[name] = err
+		}
+	}
+	return errs, nil
+}
+
+// parallelDelete deletes names in parallel, returning the errors
+// for the objects which couldn't be deleted
+func (sm *Manager) parallelDelete(names []string) map[string]error {
+	return sm.forEach(names, func(name string) error {
+		log.Printf("Deleting %q", name)
+		err := sm.Swift.ObjectDelete(sm.Container, name)
+		if err == swift.ObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Failed to delete %q: %v", name, err)
+		}
+		return err
+	})
+}
+
+// forEach calls fn for each of names using DeleteThreads workers,
+// returning the errors for the names which failed
+func (sm *Manager) forEach(names []string, fn func(name string) error) map[string]error {
+	return forEachThreads(sm.DeleteThreads, names, fn)
+}
+
+// forEachThreads calls fn for each of names using threads workers,
+// returning the errors for the names which failed
+func forEachThreads(threads int, names []string, fn func(name string) error) map[string]error {
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = map[string]error{}
+		todo = make(chan string)
+	)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range todo {
+				err := fn(name)
+				if err != nil {
+					mu.Lock()
+					errs[name] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		todo <- name
+	}
+	close(todo)
+	wg.Wait()
+	return errs
+}
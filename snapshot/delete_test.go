@@ -0,0 +1,219 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
+)
+
+// bulkDeletes watches the bulk deletes sent to a swifttest server
+// replacing the responses to some of them
+type bulkDeletes struct {
+	mu      sync.Mutex
+	objects []int // number of objects in each bulk delete
+	respond func(call int, w http.ResponseWriter) bool
+}
+
+// install makes the server advertise bulk delete of max objects and
+// watch the bulk deletes
+func (bd *bulkDeletes) install(server *swifttest.SwiftServer, max int) {
+	server.SetOverride("/info", func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"bulk_delete": map[string]interface{}{
+				"max_deletes_per_request": max,
+			},
+		})
+	})
+	server.SetOverride("/v1/AUTH_swifttest", func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+		if r.Method == "DELETE" && r.URL.Query().Get("bulk-delete") == "1" {
+			// The server has done the delete so count the objects it saw
+			var result struct {
+				NotFound int `json:"Number Not Found"`
+				Deleted  int `json:"Number Deleted"`
+			}
+			_ = json.Unmarshal(recorder.Body.Bytes(), &result)
+			bd.mu.Lock()
+			bd.objects = append(bd.objects, result.NotFound+result.Deleted)
+			call := len(bd.objects)
+			bd.mu.Unlock()
+			if bd.respond != nil && bd.respond(call, w) {
+				return
+			}
+		}
+		for k, v := range recorder.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(recorder.Code)
+		_, _ = w.Write(recorder.Body.Bytes())
+	})
+}
+
+// putTestObjects puts n objects in the container returning them
+func putTestObjects(t *testing.T, sm *Manager, n int) []swift.Object {
+	err := sm.CreateContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		err = sm.Swift.ObjectPutString(sm.Container, fmt.Sprintf("snap/obj%d", i), "data", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	objects, err := sm.Swift.ObjectsAll(sm.Container, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return objects
+}
+
+// checkDeleted checks the container is empty
+func checkDeleted(t *testing.T, sm *Manager) {
+	names, err := sm.Swift.ObjectNamesAll(sm.Container, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("objects left: %q", names)
+	}
+}
+
+func TestDeleteObjectsBulk(t *testing.T) {
+	sm, server := newTestManager(t)
+	bd := &bulkDeletes{}
+	bd.install(server, 2)
+	objects := putTestObjects(t, sm, 5)
+	err := sm.DeleteObjects(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, sm)
+	if got, want := fmt.Sprint(bd.objects), "[2 2 1]"; got != want {
+		t.Errorf("bulk deletes of %s objects want %s", got, want)
+	}
+}
+
+func TestDeleteObjectsBulkPartialFailure(t *testing.T) {
+	oldDelay := deleteRetryDelay
+	deleteRetryDelay = time.Millisecond
+	defer func() { deleteRetryDelay = oldDelay }()
+
+	sm, server := newTestManager(t)
+	bd := &bulkDeletes{
+		// Say one object of the first batch failed
+		respond: func(call int, w http.ResponseWriter) bool {
+			if call != 1 {
+				return false
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"Response Status": "400 Bad Request",
+				"Number Deleted":  1,
+				"Errors":          [][]string{{"/" + sm.Container + "/snap/obj1", "409 Conflict"}},
+			})
+			return true
+		},
+	}
+	bd.install(server, 2)
+	objects := putTestObjects(t, sm, 5)
+	err := sm.DeleteObjects(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDeleted(t, sm)
+	// Only the failed object should be retried
+	if got, want := fmt.Sprint(bd.objects), "[2 2 1 1]"; got != want {
+		t.Errorf("bulk deletes of %s objects want %s", got, want)
+	}
+	if got := sm.Metrics.retries["delete"]; got != 1 {
+		t.Errorf("counted %d retries want 1", got)
+	}
+}
+
+func TestDeleteObjectsBulkRefused(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound, http.StatusNotImplemented} {
+		sm, server := newTestManager(t)
+		bd := &bulkDeletes{
+			respond: func(call int, w http.ResponseWriter) bool {
+				w.WriteHeader(status)
+				return true
+			},
+		}
+		bd.install(server, 2)
+		objects := putTestObjects(t, sm, 5)
+		err := sm.DeleteObjects(objects)
+		if err != nil {
+			t.Fatalf("%d: %v", status, err)
+		}
+		checkDeleted(t, sm)
+		if len(bd.objects) != 1 {
+			t.Errorf("%d: want 1 bulk delete got %d", status, len(bd.objects))
+		}
+		if got := sm.Metrics.retries["delete"]; got != 0 {
+			t.Errorf("%d: counted %d retries want 0", status, got)
+		}
+	}
+}
+
+func TestDeleteObjectsFails(t *testing.T) {
+	oldDelay := deleteRetryDelay
+	deleteRetryDelay = time.Millisecond
+	defer func() { deleteRetryDelay = oldDelay }()
+
+	sm, server := newTestManager(t)
+	bd := &bulkDeletes{
+		respond: func(call int, w http.ResponseWriter) bool {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return true
+		},
+	}
+	bd.install(server, 10)
+	objects := putTestObjects(t, sm, 3)
+	err := sm.DeleteObjects(objects)
+	objectsErr, ok := err.(*ObjectsError)
+	if !ok {
+		t.Fatalf("want *ObjectsError got %v", err)
+	}
+	if len(objectsErr.Errors) != 3 {
+		t.Errorf("want 3 failed objects got %d", len(objectsErr.Errors))
+	}
+	if len(bd.objects) != deleteRetries {
+		t.Errorf("want %d bulk deletes got %d", deleteRetries, len(bd.objects))
+	}
+}
+
+func TestSnapshotCleanUp(t *testing.T) {
+	sm, _ := newTestManager(t)
+	sm.SoftDelete = true
+	s := sm.NewSnapshot("snap")
+	err := s.CleanUp()
+	if err != nil {
+		t.Fatalf("clean up without a container: %v", err)
+	}
+	putTestObjects(t, sm, 3)
+	for _, name := range []string{"snap/image.part/00000001", "snap2/README.txt"} {
+		err = sm.Swift.ObjectPutString(sm.Container, name, "data", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.CleanUp()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the other snapshot should be left, and nothing in the trash
+	names, err := sm.Swift.ObjectNamesAll(sm.Container, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(names), "[snap2/README.txt]"; got != want {
+		t.Errorf("left %s want %s", got, want)
+	}
+}
@@ -0,0 +1,312 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encryption of snapshot images
+//
+// The image is split into segments of encryptSegmentSize bytes which
+// are each sealed with AES-256-GCM.  The nonce of each segment is a
+// random prefix, the segment number and a flag marking the last
+// segment, so segments can't be reordered, dropped or truncated
+// without it being detected.
+//
+// The encrypted stream starts with a header
+//
+//	magic    [6]byte  "SMENC\x01"
+//	kdf      byte     how the key was made - encryptKdfKeyFile or encryptKdfPBKDF2
+//	salt     [16]byte salt for the passphrase
+//	prefix   [7]byte  random nonce prefix
+const (
+	// Name of the encryption scheme as stored in the README.txt
+	EncryptionScheme = "aes-256-gcm-stream"
+	// Suffix added to the names of encrypted images so the Memset
+	// control panel doesn't try to use them
+	EncryptedSuffix = ".enc"
+	// Content type of the chunks of encrypted images
+	EncryptedMimeType = "application/x-snapshot-manager-encrypted"
+
+	encryptMagic       = "SMENC\x01"
+	encryptSegmentSize = 64 * 1024
+	encryptSaltSize    = 16
+	encryptPrefixSize  = 7
+	encryptHeaderSize  = len(encryptMagic) + 1 + encryptSaltSize + encryptPrefixSize
+	encryptKdfKeyFile  = 0
+	encryptKdfPBKDF2   = 1
+	pbkdf2Iterations   = 100000
+)
+
+// EncryptionKey describes where the encryption key comes from -
+// either a key file or a passphrase
+type EncryptionKey struct {
+	KeyFile    string // file whose contents are the key
+	Passphrase string // passphrase to derive the key from
+}
+
+// IsSet returns whether a key has been configured
+func (k *EncryptionKey) IsSet() bool {
+	return k != nil && (k.KeyFile != "" || k.Passphrase != "")
+}
+
+// kdf returns how the key is made
+func (k *EncryptionKey) kdf() byte {
+	if k.KeyFile != "" {
+		return encryptKdfKeyFile
+	}
+	return encryptKdfPBKDF2
+}
+
+// kdfName returns how the key is made as stored in the README.txt
+func kdfName(kdf byte) string {
+	if kdf == encryptKdfKeyFile {
+		return "keyfile-sha256"
+	}
+	return "pbkdf2-sha256"
+}
+
+// derive makes the AES key using the method kdf and salt
+func (k *EncryptionKey) derive(kdf byte, salt []byte) ([]byte, error) {
+	switch kdf {
+	case encryptKdfKeyFile:
+		if k.KeyFile == "" {
+			return nil, errors.New("snapshot was encrypted with a key file - use -key-file")
+		}
+		data, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			return nil, fmt.Errorf("key file %q is empty", k.KeyFile)
+		}
+		key := sha256.Sum256(data)
+		return key[:], nil
+	case encryptKdfPBKDF2:
+		if k.Passphrase == "" {
+			return nil, errors.New("snapshot was encrypted with a passphrase - use -passphrase")
+		}
+		return pbkdf2([]byte(k.Passphrase), salt, pbkdf2Iterations, 32, sha256.New), nil
+	}
+	return nil, fmt.Errorf("unknown key derivation %d", kdf)
+}
+
+// pbkdf2 derives a key from password and salt as in RFC 2898
+func pbkdf2(password, salt []byte, iter, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:4])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
+
+// keyFingerprint returns a short identifier for the key which doesn't
+// reveal it
+func keyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte("snapshot-manager key fingerprint"))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// segmentNonce makes the nonce for segment n
+func segmentNonce(prefix []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], n)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// newGCM makes an AES-256-GCM AEAD from key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptReader encrypts the data read from an io.Reader
+type EncryptReader struct {
+	in          *bufio.Reader
+	aead        cipher.AEAD
+	prefix      []byte
+	n           uint32
+	buf         []byte // encrypted data waiting to be read
+	plain       []byte
+	done        bool
+	Fingerprint string // fingerprint of the key used
+	Kdf         string // how the key was made
+}
+
+// NewEncryptReader returns a reader which reads the encrypted data
+// from in using key
+func NewEncryptReader(in io.Reader, key *EncryptionKey) (*EncryptReader, error) {
+	header := make([]byte, encryptHeaderSize)
+	copy(header, encryptMagic)
+	kdf := key.kdf()
+	header[len(encryptMagic)] = kdf
+	salt := header[len(encryptMagic)+1 : len(encryptMagic)+1+encryptSaltSize]
+	prefix := header[len(header)-encryptPrefixSize:]
+	_, err := io.ReadFull(rand.Reader, header[len(encryptMagic)+1:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to make salt: %v", err)
+	}
+	aesKey, err := key.derive(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{
+		in:          bufio.NewReaderSize(in, encryptSegmentSize),
+		aead:        aead,
+		prefix:      prefix,
+		buf:         header,
+		plain:       make([]byte, encryptSegmentSize),
+		Fingerprint: keyFingerprint(aesKey),
+		Kdf:         kdfName(kdf),
+	}, nil
+}
+
+// Read encrypted data
+func (e *EncryptReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(e.in, e.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			// check whether this is the last segment
+			if _, err := e.in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		e.buf = e.aead.Seal(e.buf[:0], segmentNonce(e.prefix, e.n, last), e.plain[:n], nil)
+		e.n++
+		e.done = last
+	}
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// DecryptReader decrypts the data read from an io.Reader
+type DecryptReader struct {
+	in          *bufio.Reader
+	aead        cipher.AEAD
+	prefix      []byte
+	n           uint32
+	buf         []byte // decrypted data waiting to be read
+	sealed      []byte
+	done        bool
+	Fingerprint string // fingerprint of the key used
+}
+
+// NewDecryptReader returns a reader which decrypts the data read
+// from in using key
+func NewDecryptReader(in io.Reader, key *EncryptionKey) (*DecryptReader, error) {
+	if !key.IsSet() {
+		return nil, errors.New("snapshot is encrypted - use -key-file or -passphrase")
+	}
+	header := make([]byte, encryptHeaderSize)
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encryption header: %v", err)
+	}
+	if !strings.HasPrefix(string(header), encryptMagic) {
+		return nil, errors.New("not encrypted by snapshot-manager")
+	}
+	kdf := header[len(encryptMagic)]
+	salt := header[len(encryptMagic)+1 : len(encryptMagic)+1+encryptSaltSize]
+	aesKey, err := key.derive(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{
+		in:          bufio.NewReaderSize(in, encryptSegmentSize+aead.Overhead()),
+		aead:        aead,
+		prefix:      header[len(header)-encryptPrefixSize:],
+		sealed:      make([]byte, encryptSegmentSize+aead.Overhead()),
+		Fingerprint: keyFingerprint(aesKey),
+	}, nil
+}
+
+// Read decrypted data
+func (d *DecryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(d.in, d.sealed)
+		if err == io.EOF {
+			return 0, errors.New("encrypted data truncated")
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := err != nil
+		if !last {
+			if _, err := d.in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+		d.buf, err = d.aead.Open(d.buf[:0], segmentNonce(d.prefix, d.n, last), d.sealed[:n], nil)
+		if err != nil {
+			return 0, fmt.Errorf("decryption of segment %d failed - wrong key or corrupted data", d.n)
+		}
+		d.n++
+		d.done = last
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,218 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Size of an encrypted segment
+const sealedSegmentSize = encryptSegmentSize + 16
+
+// testKeyFile makes a key file with contents returning the key for it
+func testKeyFile(t *testing.T, contents string) *EncryptionKey {
+	dir, err := ioutil.TempDir("", "snapshot-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	file := filepath.Join(dir, "key")
+	err = ioutil.WriteFile(file, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &EncryptionKey{KeyFile: file}
+}
+
+// encrypt encrypts data with key
+func encrypt(t *testing.T, data []byte, key *EncryptionKey) []byte {
+	in, err := NewEncryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// decrypt decrypts data with key
+func decrypt(data []byte, key *EncryptionKey) ([]byte, error) {
+	in, err := NewDecryptReader(bytes.NewReader(data), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(in)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	keys := map[string]*EncryptionKey{
+		"key file":   testKeyFile(t, "0123456789abcdef0123456789abcdef"),
+		"passphrase": {Passphrase: "correct horse battery staple"},
+	}
+	for name, key := range keys {
+		for _, size := range []int{0, 1, encryptSegmentSize - 1, encryptSegmentSize, encryptSegmentSize + 1, 3*encryptSegmentSize + 5} {
+			data := testImage(size)
+			enc := encrypt(t, data, key)
+			segments := (size + encryptSegmentSize - 1) / encryptSegmentSize
+			if segments == 0 {
+				segments = 1 // an empty image still has a last segment
+			}
+			if want := encryptHeaderSize + size + 16*segments; len(enc) != want {
+				t.Errorf("%s %d: encrypted to %d bytes want %d", name, size, len(enc), want)
+			}
+			if size > 64 && bytes.Contains(enc, data[:64]) {
+				t.Errorf("%s %d: encrypted data contains the plain text", name, size)
+			}
+			got, err := decrypt(enc, key)
+			if err != nil {
+				t.Errorf("%s %d: decrypt failed: %v", name, size, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("%s %d: decrypted data differs", name, size)
+			}
+		}
+	}
+
+	// The same data encrypts differently each time
+	key := keys["key file"]
+	data := testImage(1000)
+	if bytes.Equal(encrypt(t, data, key), encrypt(t, data, key)) {
+		t.Errorf("encrypting twice gave the same result")
+	}
+}
+
+func TestEncryptTampered(t *testing.T) {
+	key := testKeyFile(t, "0123456789abcdef0123456789abcdef")
+	data := testImage(3*encryptSegmentSize + 5)
+	enc := encrypt(t, data, key)
+	segment := func(n int) []byte {
+		start := encryptHeaderSize + n*sealedSegmentSize
+		end := start + sealedSegmentSize
+		if end > len(enc) {
+			end = len(enc)
+		}
+		return enc[start:end]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := enc[:encryptHeaderSize]
+	flipped := append([]byte{}, enc...)
+	flipped[encryptHeaderSize+100] ^= 1
+
+	for _, test := range []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"truncated in a segment", enc[:len(enc)-1], "decryption of segment 3 failed"},
+		{"truncated on a segment", join(header, segment(0), segment(1), segment(2)), "decryption of segment 2 failed"},
+		{"no segments", header, "truncated"},
+		{"truncated header", enc[:encryptHeaderSize-1], "failed to read encryption header"},
+		{"reordered", join(header, segment(1), segment(0), segment(2), segment(3)), "decryption of segment 0 failed"},
+		{"segment dropped", join(header, segment(0), segment(2), segment(3)), "decryption of segment 1 failed"},
+		{"segment repeated", join(header, segment(0), segment(0), segment(1), segment(2), segment(3)), "decryption of segment 1 failed"},
+		{"bit flipped", flipped, "decryption of segment 0 failed"},
+		{"not encrypted", data, "not encrypted by snapshot-manager"},
+	} {
+		got, err := decrypt(test.data, key)
+		if err == nil {
+			t.Errorf("%s: decrypted %d bytes without an error", test.name, len(got))
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q doesn't contain %q", test.name, err, test.want)
+		}
+	}
+
+	// Segments from another stream with the same key don't fit
+	other := encrypt(t, data, key)
+	otherSegment := other[encryptHeaderSize : encryptHeaderSize+sealedSegmentSize]
+	_, err := decrypt(join(header, otherSegment, segment(1), segment(2), segment(3)), key)
+	if err == nil {
+		t.Errorf("segment from another stream decrypted")
+	}
+}
+
+func TestEncryptWrongKey(t *testing.T) {
+	keyFile := testKeyFile(t, "0123456789abcdef0123456789abcdef")
+	passphrase := &EncryptionKey{Passphrase: "correct horse battery staple"}
+	data := testImage(1000)
+	for _, test := range []struct {
+		name    string
+		encrypt *EncryptionKey
+		decrypt *EncryptionKey
+		want    string
+	}{
+		{"other key file", keyFile, testKeyFile(t, "fedcba9876543210fedcba9876543210"), "wrong key"},
+		{"other passphrase", passphrase, &EncryptionKey{Passphrase: "Correct horse battery staple"}, "wrong key"},
+		{"passphrase for key file", keyFile, &EncryptionKey{Passphrase: "x"}, "use -key-file"},
+		{"key file for passphrase", passphrase, keyFile, "use -passphrase"},
+		{"no key", keyFile, &EncryptionKey{}, "snapshot is encrypted"},
+	} {
+		enc := encrypt(t, data, test.encrypt)
+		_, err := decrypt(enc, test.decrypt)
+		if err == nil {
+			t.Errorf("%s: decrypted with the wrong key", test.name)
+		} else if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q doesn't contain %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestEncryptFingerprint(t *testing.T) {
+	key := testKeyFile(t, "0123456789abcdef0123456789abcdef")
+	e, err := NewEncryptReader(bytes.NewReader(nil), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := ioutil.ReadAll(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDecryptReader(bytes.NewReader(enc), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Fingerprint == "" || e.Fingerprint != d.Fingerprint {
+		t.Errorf("fingerprints %q and %q differ", e.Fingerprint, d.Fingerprint)
+	}
+	if e.Kdf != "keyfile-sha256" {
+		t.Errorf("kdf %q", e.Kdf)
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	for _, test := range []struct {
+		h        func() hash.Hash
+		password string
+		salt     string
+		iter     int
+		want     string
+	}{
+		// RFC 6070
+		{sha1.New, "password", "salt", 1, "0c60c80f961f0e71f3a9b524af6012062fe037a6"},
+		{sha1.New, "password", "salt", 2, "ea6c014dc72d6f8ccd1ed92ace1d41f0d8de8957"},
+		{sha1.New, "password", "salt", 4096, "4b007901b765489abead49d926f721d065a429c1"},
+		{sha1.New, "passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "3d2eec4fe41c849b80c8d83662c0e44a8b291a964cf2f07038"},
+		{sha1.New, "pass\x00word", "sa\x00lt", 4096, "56fa6aa75548099dcc37d7f03425e0c3"},
+		// SHA-256 as used for the passphrase
+		{sha256.New, "password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{sha256.New, "password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	} {
+		want, err := hex.DecodeString(test.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := pbkdf2([]byte(test.password), []byte(test.salt), test.iter, len(want), test.h)
+		if !bytes.Equal(got, want) {
+			t.Errorf("pbkdf2(%q, %q, %d) = %x want %x", test.password, test.salt, test.iter, got, want)
+		}
+	}
+}
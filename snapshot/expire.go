@@ -0,0 +1,83 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+// parseExpiry reads the X-Delete-At header returning a zero time if
+// it isn't set
+func parseExpiry(headers swift.Headers) time.Time {
+	deleteAt := headers["X-Delete-At"]
+	if deleteAt == "" {
+		return time.Time{}
+	}
+	seconds, err := strconv.ParseInt(deleteAt, 10, 64)
+	if err != nil {
+		log.Printf("Couldn't parse X-Delete-At %q - ignoring: %v", deleteAt, err)
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// expiryHeaders returns the headers to upload the objects of the
+// snapshot with so they expire at s.ExpireAt
+func (s *Snapshot) expiryHeaders() swift.Headers {
+	if s.ExpireAt.IsZero() {
+		return nil
+	}
+	return swift.Headers{
+		"X-Delete-At": strconv.FormatInt(s.ExpireAt.Unix(), 10),
+	}
+}
+
+// SetExpiry sets every object in the snapshot to be deleted at
+// expireAt.  If expireAt is zero then the expiry is removed.
+func (s *Snapshot) SetExpiry(expireAt time.Time) error {
+	sm := s.Manager
+	if !expireAt.IsZero() && expireAt.Before(time.Now()) {
+		return fmt.Errorf("expiry time %v is in the past", expireAt)
+	}
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("snapshot or snapshot objects not found")
+	}
+	s.ExpireAt = expireAt
+	var names []string
+	for _, object := range objects {
+		if !object.PseudoDirectory {
+			names = append(names, object.Name)
+		}
+	}
+
+	// Updating the object replaces its metadata, so read it first
+	// to preserve it.  Leaving out X-Delete-At removes the expiry.
+	errs := sm.forEach(names, func(name string) error {
+		_, headers, err := sm.Swift.Object(sm.Container, name)
+		if err != nil {
+			return err
+		}
+		h := headers.ObjectMetadata().ObjectHeaders()
+		if manifest := headers["X-Object-Manifest"]; manifest != "" {
+			h["X-Object-Manifest"] = manifest
+		}
+		for k, v := range s.expiryHeaders() {
+			h[k] = v
+		}
+		log.Printf("Setting expiry of %q", name)
+		return sm.Swift.ObjectUpdate(sm.Container, name, h)
+	})
+	if len(errs) != 0 {
+		return &ObjectsError{Op: "set expiry of", Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package snapshot
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Filter selects snapshots - it returns true for the ones to keep
+type Filter func(s *Snapshot) bool
+
+// Select returns the snapshots for which all the filters return true
+func Select(snapshots []*Snapshot, filters ...Filter) []*Snapshot {
+	var out []*Snapshot
+outer:
+	for _, s := range snapshots {
+		for _, filter := range filters {
+			if !filter(s) {
+				continue outer
+			}
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// MatchName selects snapshots whose names match the glob pattern
+// using path.Match syntax
+func MatchName(pattern string) (Filter, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+	}
+	return func(s *Snapshot) bool {
+		ok, _ := path.Match(pattern, s.Name)
+		return ok
+	}, nil
+}
+
+// Before selects snapshots made before t
+func Before(t time.Time) Filter {
+	return func(s *Snapshot) bool {
+		return !s.Date.IsZero() && s.Date.Before(t)
+	}
+}
+
+// OfMiniserver selects snapshots of the named Miniserver
+func OfMiniserver(miniserver string) Filter {
+	return func(s *Snapshot) bool {
+		return s.Miniserver == miniserver
+	}
+}
+
+// IsBroken selects broken snapshots
+func IsBroken(s *Snapshot) bool {
+	return s.Broken
+}
+
+// Since selects snapshots made at or after t
+func Since(t time.Time) Filter {
+	return func(s *Snapshot) bool {
+		return !s.Date.IsZero() && !s.Date.Before(t)
+	}
+}
+
+// Until selects snapshots made at or before t
+func Until(t time.Time) Filter {
+	return func(s *Snapshot) bool {
+		return !s.Date.IsZero() && !s.Date.After(t)
+	}
+}
+
+// OfType selects snapshots whose image is of the type named, eg
+// "raw" or "tar".  Gzipped images match the type they were
+// compressed from so "raw" matches ".raw.gz" images.
+func OfType(name string) Filter {
+	suffix := "." + strings.TrimPrefix(strings.ToLower(name), ".")
+	return func(s *Snapshot) bool {
+		Type := Types.Find(s.Path)
+		if Type == nil {
+			return false
+		}
+		return strings.TrimSuffix(Type.Suffix, ".gz") == suffix
+	}
+}
+
+// Ways of sorting snapshots for Sort
+var sortLess = map[string]func(a, b *Snapshot) bool{
+	"name": func(a, b *Snapshot) bool {
+		return a.Name < b.Name
+	},
+	"date": func(a, b *Snapshot) bool {
+		return a.Date.Before(b.Date)
+	},
+	"size": func(a, b *Snapshot) bool {
+		return a.DiskSize < b.DiskSize
+	},
+	"miniserver": func(a, b *Snapshot) bool {
+		return a.Miniserver < b.Miniserver
+	},
+}
+
+// Sort sorts the snapshots in place by "name", "date", "size" or
+// "miniserver", reversing the order if reverse is set.  Snapshots
+// which compare equal are kept in name order.
+func Sort(snapshots []*Snapshot, by string, reverse bool) error {
+	less, ok := sortLess[by]
+	if !ok {
+		return fmt.Errorf("can't sort by %q - use name, date, size or miniserver", by)
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		a, b := snapshots[i], snapshots[j]
+		if reverse {
+			a, b = b, a
+		}
+		if less(a, b) {
+			return true
+		}
+		if less(b, a) {
+			return false
+		}
+		return a.Name < b.Name
+	})
+	return nil
+}
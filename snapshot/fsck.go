@@ -0,0 +1,286 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+// ProblemKind describes the kind of problem Fsck found
+type ProblemKind int
+
+// Kinds of problem found by Fsck
+const (
+	ProblemOrphanedChunks = ProblemKind(iota) // chunks with no manifest
+	ProblemMissingChunks                      // manifest with missing chunks
+	ProblemMissingReadme                      // no README.txt
+)
+
+// String describes the ProblemKind
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemOrphanedChunks:
+		return "orphaned chunks"
+	case ProblemMissingChunks:
+		return "missing chunks"
+	case ProblemMissingReadme:
+		return "missing README.txt"
+	}
+	return fmt.Sprintf("unknown problem %d", int(k))
+}
+
+// Problem is a single problem found by Fsck
+type Problem struct {
+	Kind       ProblemKind
+	Prefix     string         // prefix of the chunks involved if any
+	Chunks     []swift.Object // the chunks under Prefix
+	Err        error          // details of the problem
+	Repairable bool           // whether Repair can fix it
+}
+
+// String describes the Problem
+func (p *Problem) String() string {
+	repair := "can't repair"
+	if p.Repairable {
+		repair = "repairable"
+	}
+	if p.Prefix != "" {
+		return fmt.Sprintf("%v %q (%d chunks) - %v - %s", p.Kind, p.Prefix, len(p.Chunks), p.Err, repair)
+	}
+	return fmt.Sprintf("%v - %v - %s", p.Kind, p.Err, repair)
+}
+
+// FsckReport is the result of checking a snapshot with Fsck
+type FsckReport struct {
+	Snapshot *Snapshot
+	Problems []*Problem
+	Recent   bool // not checked as it may be an upload in progress
+}
+
+// OK returns whether no problems were found
+func (r *FsckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Fsck checks the objects of the snapshot and classifies any problems
+// found with it
+//
+// Snapshots with an object modified less than minAge ago are marked
+// Recent with no problems as they may be part of an upload in
+// progress.
+func (s *Snapshot) Fsck(minAge time.Duration) (*FsckReport, error) {
+	report := &FsckReport{
+		Snapshot: s,
+	}
+	objects, err := s.Manager.Objects(s.Name)
+	if err != nil {
+		return nil, err
+	}
+	var newest time.Time
+	seen := func(objects []swift.Object) {
+		for _, object := range objects {
+			if object.LastModified.After(newest) {
+				newest = object.LastModified
+			}
+		}
+	}
+	seen(objects)
+
+	// Check the image and its chunks
+	manifestPrefix := ""
+	if s.Path != "" {
+		_, chunksContainer, chunksPrefix, err := s.Manifest()
+		if err != nil {
+			return nil, err
+		}
+		if chunksContainer != "" {
+			manifestPrefix = chunksPrefix
+			chunks, err := s.Manager.Chunks(chunksContainer, chunksPrefix)
+			if err != nil {
+				return nil, err
+			}
+			seen(chunks)
+			err = checkChunks(chunks)
+			if err != nil {
+				report.Problems = append(report.Problems, &Problem{
+					Kind:   ProblemMissingChunks,
+					Prefix: chunksPrefix,
+					Chunks: chunks,
+					Err:    err,
+				})
+			}
+		}
+	}
+
+	// Look for chunks which no manifest refers to
+	hasReadme := false
+	for _, object := range objects {
+		if object.Name == s.Name+"/README.txt" {
+			hasReadme = true
+		}
+		if !object.PseudoDirectory || !strings.HasSuffix(object.Name, ".part/") {
+			continue
+		}
+		chunksPrefix := strings.TrimRight(object.Name, "/")
+		if chunksPrefix == manifestPrefix {
+			continue
+		}
+		chunks, err := s.Manager.Chunks(s.Manager.Container, chunksPrefix+"/")
+		if err != nil {
+			return nil, err
+		}
+		seen(chunks)
+		problem := &Problem{
+			Kind:   ProblemOrphanedChunks,
+			Prefix: chunksPrefix,
+			Chunks: chunks,
+			Err:    checkChunks(chunks),
+		}
+		if problem.Err == nil {
+			problem.Err = fmt.Errorf("no manifest")
+			// Only rebuild the manifest if there isn't an image already
+			problem.Repairable = s.Path == "" && s.orphanType(problem) != nil
+		}
+		report.Problems = append(report.Problems, problem)
+	}
+
+	if !hasReadme {
+		report.Problems = append(report.Problems, &Problem{
+			Kind:       ProblemMissingReadme,
+			Err:        fmt.Errorf("no README.txt"),
+			Repairable: true,
+		})
+	}
+
+	if newest.After(time.Now().Add(-minAge)) {
+		report.Problems = nil
+		report.Recent = true
+	}
+	return report, nil
+}
+
+// checkChunks checks the chunks are numbered 1..N without gaps
+func checkChunks(chunks []swift.Object) error {
+	if len(chunks) == 0 {
+		return fmt.Errorf("no chunks found")
+	}
+	for i, chunk := range chunks {
+		n, err := chunkNumber(chunk.Name)
+		if err != nil {
+			return err
+		}
+		if n != i+1 {
+			return fmt.Errorf("expecting chunk %d but found %q", i+1, chunk.Name)
+		}
+	}
+	return nil
+}
+
+// orphanType works out the Type of the image the orphaned chunks
+// were uploaded for, from the README.txt if possible or from the
+// content type of the chunks otherwise.
+func (s *Snapshot) orphanType(problem *Problem) *Type {
+	base := strings.TrimSuffix(path.Base(problem.Prefix), ".part")
+	if s.ImageLeaf != "" {
+		Type := Types.Find(s.ImageLeaf)
+		if Type != nil && base+Type.Suffix == strings.TrimSuffix(s.ImageLeaf, EncryptedSuffix) {
+			return Type
+		}
+	}
+	return Types.FindMimeType(problem.Chunks[0].ContentType)
+}
+
+// Repair fixes the problems in the report where possible.
+//
+// Orphaned chunks are given a new manifest and a missing README.txt
+// is rebuilt from what is known about the snapshot.  If remove is
+// set then leftovers which can't be repaired are deleted, which
+// deletes the whole snapshot if it has no usable image.  If dryRun is
+// set then it only logs what it would do.
+func (r *FsckReport) Repair(remove, dryRun bool) error {
+	s := r.Snapshot
+	wasBroken := s.Broken
+	do := func(what string, fn func() error) error {
+		if dryRun {
+			log.Printf("Not %s as -dry-run set", what)
+			return nil
+		}
+		log.Printf("%s", strings.ToUpper(what[:1])+what[1:])
+		return fn()
+	}
+
+	// Rebuild the manifest for orphaned chunks
+	for _, problem := range r.Problems {
+		if !problem.Repairable || problem.Kind != ProblemOrphanedChunks {
+			continue
+		}
+		if s.Path != "" {
+			// Already rebuilt an image from other chunks
+			problem.Repairable = false
+			continue
+		}
+		Type := s.orphanType(problem)
+		leaf := strings.TrimSuffix(path.Base(problem.Prefix), ".part") + Type.Suffix
+		if s.Encryption != "" {
+			leaf += EncryptedSuffix
+		}
+		objectPath := s.Name + "/" + leaf
+		err := do(fmt.Sprintf("rebuilding manifest %q", objectPath), func() error {
+			return s.putManifest(s.Manager.Container, objectPath, s.Manager.Container, problem.Prefix, s.expiryHeaders())
+		})
+		if err != nil {
+			return fmt.Errorf("failed to rebuild manifest %q: %v", objectPath, err)
+		}
+		s.Path = objectPath
+		s.ImageLeaf = leaf
+		s.ImageType = Type.ImageType
+		s.Broken = false
+	}
+
+	// If there is no usable image then the only fix is to delete it
+	usable := s.Path != ""
+	for _, problem := range r.Problems {
+		if problem.Kind == ProblemMissingChunks {
+			usable = false
+		}
+	}
+	if !usable {
+		if !remove {
+			log.Printf("Snapshot %q can't be repaired - use -delete to remove it", s.Name)
+			return nil
+		}
+		return do(fmt.Sprintf("deleting broken snapshot %q", s.Name), s.Delete)
+	}
+
+	for _, problem := range r.Problems {
+		switch {
+		case problem.Kind == ProblemMissingReadme:
+			if s.Date.IsZero() {
+				s.Date = time.Now()
+			}
+			if s.Comment == "" || wasBroken {
+				s.Comment = "README.txt rebuilt by snapshot-manager fsck"
+			}
+			err := do("rebuilding README.txt", s.putReadme)
+			if err != nil {
+				return err
+			}
+		case problem.Kind == ProblemOrphanedChunks && !problem.Repairable:
+			if !remove {
+				log.Printf("Leaving orphaned chunks %q - use -delete to remove them", problem.Prefix)
+				continue
+			}
+			err := do(fmt.Sprintf("deleting orphaned chunks %q", problem.Prefix), func() error {
+				return s.Manager.DeleteObjects(problem.Chunks)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
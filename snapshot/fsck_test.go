@@ -0,0 +1,43 @@
+package snapshot
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFsckRecent(t *testing.T) {
+	sm, _ := newTestManager(t)
+	err := sm.CreateContainer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An upload in progress has its chunks but no manifest or README.txt
+	s := sm.NewSnapshot("uploading")
+	_, err = s.putChunkedFile(bytes.NewReader(testImage(250000)), sm.Container, s.Name+"/image.part", "application/x-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := s.Fsck(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Recent || !report.OK() {
+		t.Errorf("upload in progress not skipped: recent %v problems %v", report.Recent, report.Problems)
+	}
+
+	report, err = s.Fsck(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Recent || len(report.Problems) != 2 {
+		t.Fatalf("want 2 problems got recent %v problems %v", report.Recent, report.Problems)
+	}
+	if report.Problems[0].Kind != ProblemOrphanedChunks || !report.Problems[0].Repairable {
+		t.Errorf("want repairable orphaned chunks got %v", report.Problems[0])
+	}
+	if report.Problems[1].Kind != ProblemMissingReadme {
+		t.Errorf("want missing README.txt got %v", report.Problems[1])
+	}
+}
@@ -0,0 +1,112 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+// GcReport is the result of looking for unreferenced chunks with Gc
+type GcReport struct {
+	Referenced   int            // number of chunks referenced by a manifest
+	Unreferenced []swift.Object // chunks which no manifest references
+	Bytes        int64          // total size of the unreferenced chunks
+	Skipped      int            // unreferenced chunks too new to collect
+}
+
+// isChunk returns whether name is the name of a chunk
+func isChunk(name string) bool {
+	return strings.Contains(name, ".part/")
+}
+
+// Gc walks the whole container looking for chunks which aren't
+// referenced by any dynamic or static large object manifest in it.
+//
+// Chunks modified less than minAge ago are skipped as they may be
+// part of an upload in progress.
+func (sm *Manager) Gc(minAge time.Duration) (*GcReport, error) {
+	objects, err := sm.Swift.ObjectsAll(sm.Container, nil)
+	if err == swift.ContainerNotFound {
+		return &GcReport{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list container %q: %v", sm.Container, err)
+	}
+
+	// Find all the chunks referenced by manifests
+	var prefixes []string
+	segments := map[string]struct{}{}
+	for _, object := range objects {
+		if isChunk(object.Name) || strings.HasSuffix(object.Name, "/README.txt") {
+			continue
+		}
+		_, headers, err := sm.Swift.Object(sm.Container, object.Name)
+		if err == swift.ObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", object.Name, err)
+		}
+		if manifest := headers["X-Object-Manifest"]; manifest != "" {
+			container, prefix, err := parseManifest(manifest)
+			if err != nil {
+				return nil, fmt.Errorf("object %q: %v", object.Name, err)
+			}
+			if container == sm.Container {
+				prefixes = append(prefixes, prefix)
+			}
+		} else if headers.IsLargeObjectSLO() {
+			container, objects, err := sm.Swift.LargeObjectGetSegments(sm.Container, object.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read segments of %q: %v", object.Name, err)
+			}
+			if container == sm.Container {
+				for _, segment := range objects {
+					segments[segment.Name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	// Find the chunks which aren't referenced
+	report := &GcReport{}
+	cutoff := time.Now().Add(-minAge)
+outer:
+	for _, object := range objects {
+		if !isChunk(object.Name) {
+			continue
+		}
+		if _, ok := segments[object.Name]; ok {
+			report.Referenced++
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(object.Name, prefix) {
+				report.Referenced++
+				continue outer
+			}
+		}
+		if object.LastModified.After(cutoff) {
+			report.Skipped++
+			continue
+		}
+		report.Unreferenced = append(report.Unreferenced, object)
+		report.Bytes += object.Bytes
+	}
+	return report, nil
+}
+
+// Delete removes the unreferenced chunks found by Gc.  If dryRun is
+// set then it only logs what it would do.
+func (r *GcReport) Delete(sm *Manager, dryRun bool) error {
+	if dryRun {
+		for _, object := range r.Unreferenced {
+			log.Printf("Not deleting %q as -dry-run set", object.Name)
+		}
+		return nil
+	}
+	return sm.DeleteObjects(r.Unreferenced)
+}
@@ -1,45 +1,162 @@
 package snapshot
 
 import (
+	"bytes"
 	"compress/gzip"
+	"fmt"
 	"io"
+	"sync"
 )
 
+// gzipBlockSize is the amount of uncompressed data compressed into
+// each gzip member by GzipReader
+const gzipBlockSize = 1024 * 1024
+
 // GzipReader is an adaptor to allow reading compressed data from an
 // uncompressed input
+//
+// The input is split into blocks which are compressed in parallel
+// as separate gzip members and written out in order.  The output is
+// a multi-member gzip stream which can be read by the standard
+// gunzip tool and gzip.Reader.
 type GzipReader struct {
-	fileRd         io.Reader
-	pipeRd         io.ReadCloser
-	pipeWr, gzipWr io.WriteCloser
-	err            error
+	fileRd  io.Reader
+	pipeRd  *io.PipeReader
+	pipeWr  *io.PipeWriter
+	level   int
+	threads int
+	quit    chan struct{}
+	mu      sync.Mutex
+	err     error
+}
+
+// gzipBlock is a block of data being compressed
+type gzipBlock struct {
+	buf  bytes.Buffer
+	err  error
+	done chan struct{}
 }
 
 // NewGzipReader takes an io.Reader and returns an io.ReadCloser which
 // reads compressed data.
-func NewGzipReader(fileRd io.Reader) (*GzipReader, error) {
-	// Pump data into gzip.Writer through the pipe and
-	// give a reader to putChunkedFile
-	var err error
+//
+// level is the gzip compression level from 1 to 9 and threads is the
+// number of blocks to compress in parallel.
+func NewGzipReader(fileRd io.Reader, level, threads int) (*GzipReader, error) {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d - use 1-9", level)
+	}
+	if threads < 1 {
+		threads = 1
+	}
 	z := &GzipReader{
-		fileRd: fileRd,
+		fileRd:  fileRd,
+		level:   level,
+		threads: threads,
+		quit:    make(chan struct{}),
 	}
 	z.pipeRd, z.pipeWr = io.Pipe()
-	z.gzipWr, err = gzip.NewWriterLevel(z.pipeWr, 6)
-	if err != nil {
-		return nil, err
-	}
-	// Pump the data through the pipe and return errors
+
+	// Blocks in the order they must be written out - the buffer
+	// limits the number of blocks being compressed to threads
+	blocks := make(chan *gzipBlock, threads-1)
+
+	// Read the input into blocks and compress them in parallel
 	go func() {
-		_, err := io.Copy(z.gzipWr, z.fileRd)
-		z.setErr(err)
-		z.setErr(z.gzipWr.Close())
-		z.setErr(z.pipeWr.Close())
+		defer close(blocks)
+		for {
+			select {
+			case <-z.quit:
+				return
+			default:
+			}
+			in := make([]byte, gzipBlockSize)
+			n, err := io.ReadFull(z.fileRd, in)
+			if err == io.EOF {
+				return
+			} else if err != nil && err != io.ErrUnexpectedEOF {
+				block := &gzipBlock{err: err, done: make(chan struct{})}
+				close(block.done)
+				blocks <- block
+				return
+			}
+			block := &gzipBlock{done: make(chan struct{})}
+			blocks <- block
+			go z.compress(block, in[:n])
+			if err == io.ErrUnexpectedEOF {
+				return
+			}
+		}
+	}()
+
+	// Write the compressed blocks into the pipe in order
+	go func() {
+		written := false
+		for block := range blocks {
+			<-block.done
+			if block.err != nil {
+				z.closeWithError(block.err)
+				// drain the remaining blocks
+				for range blocks {
+				}
+				return
+			}
+			_, err := z.pipeWr.Write(block.buf.Bytes())
+			if err != nil {
+				z.closeWithError(err)
+				for range blocks {
+				}
+				return
+			}
+			written = true
+		}
+		// Make sure an empty input produces a valid gzip stream
+		if !written {
+			block := &gzipBlock{done: make(chan struct{})}
+			z.compress(block, nil)
+			if block.err != nil {
+				z.closeWithError(block.err)
+				return
+			}
+			_, err := z.pipeWr.Write(block.buf.Bytes())
+			if err != nil {
+				z.closeWithError(err)
+				return
+			}
+		}
+		z.closeWithError(nil)
 	}()
 	return z, nil
 }
 
+// compress in into a single gzip member in block
+func (z *GzipReader) compress(block *gzipBlock, in []byte) {
+	defer close(block.done)
+	gzipWr, err := gzip.NewWriterLevel(&block.buf, z.level)
+	if err != nil {
+		block.err = err
+		return
+	}
+	_, err = gzipWr.Write(in)
+	if err != nil {
+		block.err = err
+		return
+	}
+	block.err = gzipWr.Close()
+}
+
+// closeWithError closes the write end of the pipe, passing err to
+// the reader, and stops reading the input
+func (z *GzipReader) closeWithError(err error) {
+	z.setErr(err)
+	close(z.quit)
+	_ = z.pipeWr.CloseWithError(err)
+}
+
 // setErr sets z.err if it is nil and err != nil
 func (z *GzipReader) setErr(err error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
 	if err != nil && z.err == nil {
 		z.err = err
 	}
@@ -47,15 +164,14 @@ func (z *GzipReader) setErr(err error) {
 
 // Read compressed data
 func (z *GzipReader) Read(p []byte) (int, error) {
-	if z.err != nil {
-		return 0, z.err
-	}
 	return z.pipeRd.Read(p)
 }
 
 // Close the reader - you must call this and check the error
 func (z *GzipReader) Close() error {
 	z.setErr(z.pipeRd.Close())
+	z.mu.Lock()
+	defer z.mu.Unlock()
 	return z.err
 }
 
@@ -0,0 +1,136 @@
+package snapshot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// gzipTestData makes n bytes which compress a bit but not too much
+func gzipTestData(n int) []byte {
+	data := make([]byte, n)
+	x := uint32(1)
+	for i := range data {
+		x = x*1664525 + 1013904223
+		data[i] = "abcdefgh"[x>>29]
+	}
+	return data
+}
+
+// gzipMembers counts the gzip members in data
+func gzipMembers(t *testing.T, data []byte) int {
+	br := bytes.NewReader(data)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := 0
+	for {
+		zr.Multistream(false)
+		_, err = io.Copy(ioutil.Discard, zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		members++
+		err = zr.Reset(br)
+		if err == io.EOF {
+			return members
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGzipReader(t *testing.T) {
+	for _, size := range []int{0, 1, gzipBlockSize, gzipBlockSize + 1, 5*gzipBlockSize + 12345} {
+		data := gzipTestData(size)
+		for _, threads := range []int{1, 4} {
+			z, err := NewGzipReader(bytes.NewReader(data), 1, threads)
+			if err != nil {
+				t.Fatal(err)
+			}
+			compressed, err := ioutil.ReadAll(z)
+			if err != nil {
+				t.Fatalf("%d bytes %d threads: read failed: %v", size, threads, err)
+			}
+			err = z.Close()
+			if err != nil {
+				t.Fatalf("%d bytes %d threads: close failed: %v", size, threads, err)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("%d bytes %d threads: bad gzip: %v", size, threads, err)
+			}
+			got, err := ioutil.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("%d bytes %d threads: gunzip failed: %v", size, threads, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%d bytes %d threads: decompressed %d bytes which differ", size, threads, len(got))
+			}
+			want := (size + gzipBlockSize - 1) / gzipBlockSize
+			if want == 0 {
+				want = 1
+			}
+			if got := gzipMembers(t, compressed); got != want {
+				t.Errorf("%d bytes %d threads: %d gzip members want %d", size, threads, got, want)
+			}
+		}
+	}
+}
+
+func TestGzipReaderLevel(t *testing.T) {
+	for _, level := range []int{-2, -1, 0, 10} {
+		_, err := NewGzipReader(bytes.NewReader(nil), level, 1)
+		if err == nil {
+			t.Errorf("level %d: no error", level)
+		}
+	}
+	for level := 1; level <= 9; level++ {
+		z, err := NewGzipReader(bytes.NewReader([]byte("hello")), level, 1)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		_, err = ioutil.ReadAll(z)
+		if err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+		if err = z.Close(); err != nil {
+			t.Fatalf("level %d: %v", level, err)
+		}
+	}
+}
+
+// errorReader returns data then err
+type errorReader struct {
+	data []byte
+	err  error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestGzipReaderError(t *testing.T) {
+	readErr := errors.New("disk on fire")
+	z, err := NewGzipReader(&errorReader{data: gzipTestData(3 * gzipBlockSize), err: readErr}, 6, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(z)
+	if err != readErr {
+		t.Errorf("read error %v want %v", err, readErr)
+	}
+	if err = z.Close(); err != readErr {
+		t.Errorf("close error %v want %v", err, readErr)
+	}
+}
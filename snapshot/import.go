@@ -0,0 +1,261 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Number of times to try to resume an import before giving up
+const importRetries = 5
+
+var (
+	// How long to wait between resumes, multiplied by the retry number
+	importRetryDelay = time.Second
+
+	// How long a read may wait for data before the connection is
+	// treated as broken and resumed
+	importIdleTimeout = 60 * time.Second
+
+	// Client used to import with timeouts on each stage of the
+	// request, but not the whole transfer which may take hours
+	importClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   30 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+)
+
+// httpReader reads a URL, resuming with a Range request from where
+// it got to if the connection breaks
+type httpReader struct {
+	client    *http.Client
+	idle      time.Duration // longest a read may wait for data
+	url       string
+	body      io.ReadCloser
+	header    http.Header // headers of the first response
+	offset    int64       // bytes read so far
+	size      int64       // Content-Length or -1 if not known
+	validator string      // ETag or Last-Modified to check with If-Range
+	ranges    bool        // set if the server accepts Range requests
+	retries   int
+}
+
+// openHttp starts reading rawurl with client
+func openHttp(client *http.Client, rawurl string) (*httpReader, error) {
+	r := &httpReader{
+		client: client,
+		idle:   importIdleTimeout,
+		url:    rawurl,
+	}
+	resp, err := r.get(nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("failed to fetch %q: %s", rawurl, resp.Status)
+	}
+	r.body = resp.Body
+	r.header = resp.Header
+	r.size = resp.ContentLength
+	r.ranges = resp.Header.Get("Accept-Ranges") == "bytes"
+	r.validator = validator(resp.Header)
+	return r, nil
+}
+
+// validator returns the ETag or Last-Modified from h to check the
+// object hasn't changed with If-Range
+func validator(h http.Header) string {
+	v := h.Get("Etag")
+	if v == "" || strings.HasPrefix(v, "W/") {
+		v = h.Get("Last-Modified")
+	}
+	return v
+}
+
+// get does a GET request on the URL with the extra headers h
+func (r *httpReader) get(h http.Header) (*http.Response, error) {
+	req, err := http.NewRequest("GET", r.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("bad URL %q: %v", r.url, err)
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	// Stop the transport decompressing the image
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %v", r.url, err)
+	}
+	return resp, nil
+}
+
+// readBody reads from the body closing it if no data arrives within
+// the idle timeout so a stalled connection becomes an error
+func (r *httpReader) readBody(p []byte) (int, error) {
+	body := r.body
+	var timedOut int32
+	timer := time.AfterFunc(r.idle, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		_ = body.Close()
+	})
+	n, err := body.Read(p)
+	if !timer.Stop() && atomic.LoadInt32(&timedOut) != 0 {
+		err = fmt.Errorf("no data received for %v", r.idle)
+	}
+	return n, err
+}
+
+// Read reads from the URL, resuming if the connection breaks or stalls
+func (r *httpReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = r.readBody(p)
+		r.offset += int64(n)
+		if err == io.EOF && r.size >= 0 && r.offset < r.size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		err = r.resume(err)
+		if err != nil || n > 0 {
+			return n, err
+		}
+	}
+}
+
+// resume restarts the download from offset after the error cause
+func (r *httpReader) resume(cause error) error {
+	_ = r.body.Close()
+	r.body = http.NoBody
+	if !r.ranges {
+		return fmt.Errorf("failed to read %q and the server can't resume: %v", r.url, cause)
+	}
+	for {
+		if r.retries >= importRetries {
+			return fmt.Errorf("failed to read %q after %d retries: %v", r.url, r.retries, cause)
+		}
+		r.retries++
+		log.Printf("Resuming %q from byte %d after error: %v", r.url, r.offset, cause)
+		time.Sleep(time.Duration(r.retries) * importRetryDelay)
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		if r.validator != "" {
+			h.Set("If-Range", r.validator)
+		}
+		resp, err := r.get(h)
+		if err != nil {
+			cause = err
+			continue
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", r.offset)):
+			r.body = resp.Body
+			return nil
+		case resp.StatusCode == http.StatusOK && (r.validator == "" || validator(resp.Header) == r.validator):
+			_ = resp.Body.Close()
+			return fmt.Errorf("failed to resume %q: the server ignored the Range request", r.url)
+		case resp.StatusCode == http.StatusOK:
+			_ = resp.Body.Close()
+			return fmt.Errorf("failed to resume %q: it has changed since the import started", r.url)
+		default:
+			_ = resp.Body.Close()
+			cause = fmt.Errorf("bad response to resume: %s", resp.Status)
+		}
+	}
+}
+
+// Close the URL
+func (r *httpReader) Close() error {
+	return r.body.Close()
+}
+
+// Import streams the image at rawurl into the snapshot
+//
+// The type of the image comes from typeName if set, eg "raw",
+// otherwise from the suffix of the URL or failing that its
+// Content-Type.  The image isn't written to local disk.  If the
+// connection breaks or stalls the download is resumed with a Range
+// request if the server supports it.
+func (s *Snapshot) Import(rawurl, typeName string) (err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("bad URL %q: %v", rawurl, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("can only import from http or https URLs not %q", rawurl)
+	}
+	in, err := openHttp(importClient, rawurl)
+	if err != nil {
+		return err
+	}
+	defer checkClose(in, &err)
+
+	// Work out the type and the name of the image
+	leaf := strings.ToLower(path.Base(u.Path))
+	if leaf == "." || leaf == "/" {
+		leaf = s.Name
+	}
+	var Type *Type
+	switch {
+	case typeName != "":
+		Type = Types.Find("." + strings.TrimPrefix(typeName, "."))
+		if Type == nil {
+			return fmt.Errorf("unknown snapshot type %q - use types command to see available", typeName)
+		}
+	case Types.Find(leaf) != nil:
+		Type = Types.Find(leaf)
+	default:
+		contentType := in.header.Get("Content-Type")
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		Type = Types.FindMimeType(mediaType)
+		if Type == nil {
+			return fmt.Errorf("can't work out the type of %q with Content-Type %q - use -type", rawurl, contentType)
+		}
+	}
+	if !strings.HasSuffix(leaf, Type.Suffix) {
+		leaf += Type.Suffix
+	}
+	s.ImageLeaf = leaf
+	s.Path = s.Name + "/" + leaf
+	Type, err = s.uploadType(leaf)
+	if err != nil {
+		return err
+	}
+
+	// Use the modification time of the source if known
+	s.Date = time.Now()
+	if lastModified, err := http.ParseTime(in.header.Get("Last-Modified")); err == nil {
+		s.Date = lastModified
+	}
+	if in.size < 0 {
+		log.Printf("Size of %q not known - counting it", rawurl)
+	}
+	err = s.put(in, Type, in.size)
+	s.Manager.Metrics.retry("import", in.retries)
+	if err != nil {
+		return err
+	}
+	if in.retries != 0 {
+		log.Printf("Import of %q needed %d resumes", rawurl, in.retries)
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift"
+	"github.com/ncw/swift/swifttest"
+)
+
+// newTestManager returns a Manager talking to an in memory Swift
+// server which is stopped at the end of the test
+func newTestManager(t *testing.T) (*Manager, *swifttest.SwiftServer) {
+	server, err := swifttest.NewSwiftServer("localhost")
+	if err != nil {
+		t.Fatalf("failed to start swift server: %v", err)
+	}
+	t.Cleanup(server.Close)
+	c := &swift.Connection{
+		UserName: "swifttest",
+		ApiKey:   "swifttest",
+		AuthUrl:  server.AuthURL,
+	}
+	err = c.Authenticate()
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	sm := &Manager{
+		Swift:     c,
+		ChunkSize: 100000,
+	}
+	sm.Init()
+	return sm, server
+}
+
+// importServer serves an image to import, misbehaving as configured
+type importServer struct {
+	mu          sync.Mutex
+	data        []byte
+	etag        string
+	contentType string
+	ranges      bool          // advertise Accept-Ranges
+	ignoreRange bool          // send the whole image whatever the Range
+	changeEtag  string        // new ETag to change to after the first request
+	breakAt     int           // break the first response after this many bytes
+	stallAt     int           // stall the first response after this many bytes
+	stall       time.Duration // how long to stall for
+	requests    []http.Header // headers of the requests received
+}
+
+func (is *importServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	is.mu.Lock()
+	is.requests = append(is.requests, r.Header.Clone())
+	first := len(is.requests) == 1
+	etag := is.etag
+	if !first && is.changeEtag != "" {
+		etag = is.changeEtag
+	}
+	is.mu.Unlock()
+
+	h := w.Header()
+	h.Set("Etag", etag)
+	if is.contentType != "" {
+		h.Set("Content-Type", is.contentType)
+	}
+	if is.ranges {
+		h.Set("Accept-Ranges", "bytes")
+	}
+	var start int
+	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" && is.ranges && !is.ignoreRange && r.Header.Get("If-Range") == etag {
+		_, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &start)
+		if err != nil {
+			http.Error(w, "bad range", http.StatusBadRequest)
+			return
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(is.data)-1, len(is.data)))
+		h.Set("Content-Length", fmt.Sprint(len(is.data)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		h.Set("Content-Length", fmt.Sprint(len(is.data)))
+		w.WriteHeader(http.StatusOK)
+	}
+	data := is.data[start:]
+	switch {
+	case first && is.breakAt > 0:
+		_, _ = w.Write(data[:is.breakAt])
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	case first && is.stallAt > 0:
+		_, _ = w.Write(data[:is.stallAt])
+		w.(http.Flusher).Flush()
+		time.Sleep(is.stall)
+		panic(http.ErrAbortHandler)
+	}
+	_, _ = w.Write(data)
+}
+
+// testImport imports from is into a new snapshot returning it and the
+// error from Import
+func testImport(t *testing.T, is *importServer, urlPath, typeName string) (*Snapshot, error) {
+	oldDelay, oldIdle := importRetryDelay, importIdleTimeout
+	importRetryDelay, importIdleTimeout = time.Millisecond, 100*time.Millisecond
+	defer func() {
+		importRetryDelay, importIdleTimeout = oldDelay, oldIdle
+	}()
+	server := httptest.NewServer(is)
+	defer server.Close()
+	sm, _ := newTestManager(t)
+	url := server.URL + urlPath
+	s := sm.NewSnapshotForImport("imported", url)
+	return s, s.Import(url, typeName)
+}
+
+// testImage makes an image of n bytes
+func testImage(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+// checkImported checks s holds data
+func checkImported(t *testing.T, s *Snapshot, data []byte) {
+	var buf bytes.Buffer
+	err := s.Download(&buf)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("imported %d bytes which differ from the %d bytes served", buf.Len(), len(data))
+	}
+}
+
+func TestImportResume(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		is   *importServer
+	}{
+		{"broken", &importServer{breakAt: 150000}},
+		{"stalled", &importServer{stallAt: 150000, stall: time.Second}},
+	} {
+		data := testImage(300000)
+		is := test.is
+		is.data = data
+		is.etag = `"v1"`
+		is.ranges = true
+		s, err := testImport(t, is, "/image.tar", "")
+		if err != nil {
+			t.Fatalf("%s: import failed: %v", test.name, err)
+		}
+		checkImported(t, s, data)
+		if len(is.requests) != 2 {
+			t.Fatalf("%s: want 2 requests got %d", test.name, len(is.requests))
+		}
+		h := is.requests[1]
+		if got, want := h.Get("Range"), "bytes=150000-"; got != want {
+			t.Errorf("%s: Range %q want %q", test.name, got, want)
+		}
+		if got, want := h.Get("If-Range"), `"v1"`; got != want {
+			t.Errorf("%s: If-Range %q want %q", test.name, got, want)
+		}
+		if got := s.Manager.Metrics.retries["import"]; got != 1 {
+			t.Errorf("%s: counted %d retries want 1", test.name, got)
+		}
+	}
+}
+
+func TestImportCantResume(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		is   *importServer
+		want string
+	}{
+		{"no ranges", &importServer{ranges: false}, "server can't resume"},
+		{"range ignored", &importServer{ranges: true, ignoreRange: true}, "ignored the Range request"},
+		{"changed", &importServer{ranges: true, changeEtag: `"v2"`}, "has changed since the import started"},
+	} {
+		is := test.is
+		is.data = testImage(300000)
+		is.etag = `"v1"`
+		is.breakAt = 150000
+		s, err := testImport(t, is, "/image.tar", "")
+		if err == nil {
+			t.Fatalf("%s: import succeeded", test.name)
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error %q doesn't contain %q", test.name, err, test.want)
+		}
+		// Only the chunks uploaded so far should be left
+		objects, err := s.Manager.Swift.ObjectNamesAll(s.Manager.Container, &swift.ObjectsOpts{Prefix: s.Name + "/"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, object := range objects {
+			if !strings.HasPrefix(object, s.Name+"/image.part/") {
+				t.Errorf("%s: failed import left %q", test.name, object)
+			}
+		}
+	}
+}
+
+func TestImportType(t *testing.T) {
+	for _, test := range []struct {
+		name        string
+		urlPath     string
+		typeName    string
+		contentType string
+		leaf        string
+		err         string
+	}{
+		{"suffix", "/image.tar", "", "application/octet-stream", "image.tar", ""},
+		{"content type", "/download", "", "application/x-tar", "download.tar", ""},
+		{"content type with parameters", "/download", "", "application/x-tar; charset=binary", "download.tar", ""},
+		{"type flag", "/download", "tar", "", "download.tar", ""},
+		{"unknown", "/download", "", "application/octet-stream", "", "use -type"},
+	} {
+		data := testImage(1000)
+		is := &importServer{data: data, etag: `"v1"`, contentType: test.contentType}
+		s, err := testImport(t, is, test.urlPath, test.typeName)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: import failed: %v", test.name, err)
+		}
+		if s.ImageLeaf != test.leaf {
+			t.Errorf("%s: leaf %q want %q", test.name, s.ImageLeaf, test.leaf)
+		}
+		if s.ImageType != "Tarball file" {
+			t.Errorf("%s: image type %q", test.name, s.ImageType)
+		}
+		checkImported(t, s, data)
+	}
+}
@@ -0,0 +1,97 @@
+package snapshot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ncw/swift"
+)
+
+// Info shows everything known about the snapshot on stdout - the
+// parsed fields, the README.txt, the objects, the manifest and any
+// custom metadata.
+func (s *Snapshot) Info() error {
+	sm := s.Manager
+	s.List()
+
+	if s.ReadMe != "" {
+		fmt.Printf("README.txt\n")
+		for _, line := range strings.Split(strings.TrimRight(s.ReadMe, "\n"), "\n") {
+			fmt.Printf("  %s\n", line)
+		}
+	}
+
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
+	}
+	fmt.Printf("Objects\n")
+	for _, object := range objects {
+		fmt.Printf("  %s\n", object.Name)
+		fmt.Printf("    Bytes        - %d\n", object.Bytes)
+		fmt.Printf("    ETag         - %s\n", object.Hash)
+		fmt.Printf("    ContentType  - %s\n", object.ContentType)
+		fmt.Printf("    LastModified - %s\n", object.LastModified)
+	}
+
+	// Show the metadata of the image and README.txt
+	for _, name := range []string{s.Path, s.Name + "/README.txt"} {
+		if name == "" {
+			continue
+		}
+		_, headers, err := sm.Swift.Object(sm.Container, name)
+		if err == swift.ObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %v", name, err)
+		}
+		if name == s.Path {
+			err = s.infoManifest(headers)
+			if err != nil {
+				return err
+			}
+		}
+		metadata := headers.ObjectMetadata()
+		if len(metadata) == 0 {
+			continue
+		}
+		fmt.Printf("Metadata of %s\n", name)
+		var keys []string
+		for key := range metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("  %s - %s\n", key, metadata[key])
+		}
+	}
+	return nil
+}
+
+// infoManifest shows the manifest of the image from its headers
+func (s *Snapshot) infoManifest(headers swift.Headers) error {
+	sm := s.Manager
+	fmt.Printf("Manifest\n")
+	if manifest := headers["X-Object-Manifest"]; manifest != "" {
+		fmt.Printf("  X-Object-Manifest - %s\n", manifest)
+	} else if headers.IsLargeObjectSLO() {
+		container, segments, err := sm.Swift.LargeObjectGetSegments(sm.Container, s.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read segments of %q: %v", s.Path, err)
+		}
+		fmt.Printf("  Static large object with %d segments in %q\n", len(segments), container)
+		for _, segment := range segments {
+			fmt.Printf("    %s - %d bytes - %s\n", segment.Name, segment.Bytes, segment.Hash)
+		}
+	} else {
+		fmt.Printf("  Image is a single object\n")
+	}
+	if deleteAt := headers["X-Delete-At"]; deleteAt != "" {
+		fmt.Printf("  X-Delete-At - %s (%v)\n", deleteAt, parseExpiry(headers))
+	}
+	return nil
+}
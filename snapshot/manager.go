@@ -1,19 +1,43 @@
 package snapshot
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ncw/swift"
 )
 
 // Manages snapshots in the container
 type Manager struct {
-	Swift     *swift.Connection
-	ChunkSize int
-	Container string
+	Swift           *swift.Connection
+	ChunkSize       int
+	Container       string
+	CompressLevel   int                // gzip compression level for NeedsGzip types
+	CompressThreads int                // number of blocks to compress in parallel
+	Decompress      bool               // decompress gzipped images on download
+	DeleteThreads   int                // number of objects to delete in parallel
+	SoftDelete      bool               // move deleted snapshots to the trash
+	TrashExpire     time.Duration      // how long snapshots stay in the trash
+	ListThreads     int                // number of snapshots to read in parallel
+	TransferThreads int                // number of objects to transfer in parallel
+	BwLimit         BwTimetable        // bandwidth limit for uploads and downloads if set
+	CacheFile       string             // file to cache README.txt in if set
+	KeyFile         string             // file with the encryption key if set
+	Passphrase      string             // passphrase to make the encryption key from if set
+	SignKey         ed25519.PrivateKey // key to sign uploads with if set
+	MetricsFile     string             // file to write the metrics to after each operation if set
+	Metrics         *Metrics           // what the Manager has done
+	cache           *readmeCache
+	bwLimiter       *bwLimiter
+	bulkDeleteOnce  sync.Once
+	bulkDeleteMax   int // max objects per bulk delete or 0 if not supported
 }
 
 // Init makes the Manager object ready, setting default items
@@ -24,18 +48,60 @@ func (sm *Manager) Init() {
 	if sm.Container == "" {
 		sm.Container = DefaultContainer
 	}
+	if sm.CompressLevel == 0 {
+		sm.CompressLevel = DefaultCompressLevel
+	}
+	if sm.CompressThreads == 0 {
+		sm.CompressThreads = runtime.NumCPU()
+	}
+	if sm.DeleteThreads == 0 {
+		sm.DeleteThreads = 16
+	}
+	if sm.TrashExpire == 0 {
+		sm.TrashExpire = DefaultTrashExpire
+	}
+	if sm.ListThreads == 0 {
+		sm.ListThreads = 8
+	}
+	if sm.TransferThreads == 0 {
+		sm.TransferThreads = 4
+	}
+	if sm.CacheFile != "" {
+		sm.cache = newReadmeCache(sm.CacheFile)
+	}
+	if len(sm.BwLimit) != 0 {
+		sm.bwLimiter = newBwLimiter(sm.BwLimit)
+	}
+	if sm.Metrics == nil {
+		sm.Metrics = newMetrics(sm.MetricsFile)
+	}
+}
+
+// key returns the encryption key
+func (sm *Manager) key() *EncryptionKey {
+	return &EncryptionKey{
+		KeyFile:    sm.KeyFile,
+		Passphrase: sm.Passphrase,
+	}
 }
 
 // Check the Container exists
 func (sm *Manager) Check() (bool, error) {
-	_, _, err := sm.Swift.Container(sm.Container)
+	container, err := sm.container()
+	return container != nil, err
+}
+
+// container reads the info about the Container returning nil if it
+// doesn't exist
+func (sm *Manager) container() (*swift.Container, error) {
+	container, _, err := sm.Swift.Container(sm.Container)
 	if err == swift.ContainerNotFound {
-		return false, nil
+		return nil, nil
 	}
 	if err != nil {
-		return false, fmt.Errorf("error for container %q: %v", sm.Container, err)
+		return nil, fmt.Errorf("error for container %q: %v", sm.Container, err)
 	}
-	return true, nil
+	return &container, nil
 }
 
 // Create the container if it doesn't exist
@@ -55,7 +121,7 @@ func (sm *Manager) CreateContainer() error {
 
 // Read the objects in the snapshot
 func (sm *Manager) Objects(name string) ([]swift.Object, error) {
-	objects, err := sm.Swift.Objects(sm.Container, &swift.ObjectsOpts{
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
 		Prefix:    name + "/",
 		Delimiter: '/',
 	})
@@ -65,6 +131,31 @@ func (sm *Manager) Objects(name string) ([]swift.Object, error) {
 	return objects, nil
 }
 
+// readReadme reads the README.txt object and its expiry, using the
+// cache if possible
+func (sm *Manager) readReadme(object swift.Object) (readme string, expireAt time.Time, err error) {
+	key := cacheKey(object.Hash, object.LastModified)
+	if sm.cache != nil {
+		if entry, ok := sm.cache.get(object.Name, key); ok {
+			return entry.ReadMe, entry.ExpireAt, nil
+		}
+	}
+	var buf bytes.Buffer
+	headers, err := sm.Swift.ObjectGet(sm.Container, object.Name, &buf, true, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	readme, expireAt = buf.String(), parseExpiry(headers)
+	if sm.cache != nil {
+		sm.cache.put(object.Name, readmeCacheEntry{
+			Key:      key,
+			ReadMe:   readme,
+			ExpireAt: expireAt,
+		})
+	}
+	return readme, expireAt, nil
+}
+
 // ReadSnapshot gets info about snapshot from container
 func (sm *Manager) ReadSnapshot(name string) (*Snapshot, error) {
 	s := &Snapshot{
@@ -80,12 +171,17 @@ func (sm *Manager) ReadSnapshot(name string) (*Snapshot, error) {
 	// check for README.txt for the user comment
 	for _, object := range objects {
 		if strings.HasSuffix(object.Name, "README.txt") {
-			readme, err := sm.Swift.ObjectGetString(sm.Container, object.Name)
+			readme, expireAt, err := sm.readReadme(object)
 			if err != nil {
 				log.Printf("Couldn't read %q - ignoring: %v", object.Name, err)
 				continue
 			}
-			s.ParseReadme(readme)
+			// all the objects in the snapshot expire together
+			s.ExpireAt = expireAt
+			err = s.ParseReadme(readme)
+			if err != nil {
+				log.Printf("Couldn't parse %q - ignoring: %v", object.Name, err)
+			}
 		}
 	}
 
@@ -133,16 +229,70 @@ func (sm *Manager) NewSnapshotForUpload(name, file string) *Snapshot {
 	return s
 }
 
+// NewSnapshotForImport makes an empty snapshot from a name and the
+// URL it is to be imported from
+func (sm *Manager) NewSnapshotForImport(name, url string) *Snapshot {
+	s := sm.NewSnapshot(name)
+	s.Comment = fmt.Sprintf("Imported from '%s'", url)
+	s.Miniserver = "uploaded"
+	return s
+}
+
+// readSnapshots reads the named snapshots using ListThreads workers
+// returning them in the same order as the names
+func (sm *Manager) readSnapshots(names []string) ([]*Snapshot, error) {
+	snapshots := make([]*Snapshot, len(names))
+	errs := make([]error, len(names))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < sm.ListThreads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				snapshots[i], errs[i] = sm.ReadSnapshot(names[i])
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return snapshots, nil
+}
+
+// saveCache saves the README.txt cache if in use, pruning entries
+// for snapshots not seen if prune is set
+func (sm *Manager) saveCache(prune bool) {
+	if sm.cache == nil {
+		return
+	}
+	err := sm.cache.save(prune)
+	if err != nil {
+		log.Printf("Couldn't save cache %q: %v", sm.CacheFile, err)
+	}
+}
+
 // List all snapshots in the container
-func (sm *Manager) List() ([]*Snapshot, error) {
-	ok, err := sm.Check()
+func (sm *Manager) List() (snapshots []*Snapshot, err error) {
+	defer func() {
+		sm.Metrics.record("list", err)
+	}()
+	container, err := sm.container()
 	if err != nil {
 		return nil, err
 	}
-	if !ok {
+	if container == nil {
+		sm.Metrics.listedSnapshots(nil, 0)
 		return nil, nil
 	}
-	objects, err := sm.Swift.Objects(sm.Container, &swift.ObjectsOpts{
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
 		Prefix:    "",
 		Delimiter: '/',
 	})
@@ -150,18 +300,20 @@ func (sm *Manager) List() ([]*Snapshot, error) {
 		return nil, fmt.Errorf("failed to list snapshots: %v", err)
 	}
 	if len(objects) == 0 {
+		sm.Metrics.listedSnapshots(nil, container.Bytes)
 		return nil, nil
 	}
-	var snapshots []*Snapshot
+	var names []string
 	for _, obj := range objects {
-		if obj.PseudoDirectory {
-			name := strings.TrimRight(obj.Name, "/")
-			s, err := sm.ReadSnapshot(name)
-			if err != nil {
-				return nil, err
-			}
-			snapshots = append(snapshots, s)
+		if obj.PseudoDirectory && !strings.HasPrefix(obj.Name, TrashPrefix) {
+			names = append(names, strings.TrimRight(obj.Name, "/"))
 		}
 	}
+	snapshots, err = sm.readSnapshots(names)
+	if err != nil {
+		return nil, err
+	}
+	sm.saveCache(true)
+	sm.Metrics.listedSnapshots(snapshots, container.Bytes)
 	return snapshots, nil
 }
@@ -0,0 +1,257 @@
+package snapshot
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations counted by the metrics
+var metricsOps = []string{"list", "upload", "download", "delete"}
+
+// Operations which retry, counted by the metrics
+var metricsRetryOps = []string{"delete", "import"}
+
+// Upper bounds of the buckets of the chunk PUT latency histogram in
+// seconds
+var chunkPutBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// Metrics counts what a Manager does so it can be monitored by
+// Prometheus
+//
+// The metrics can be served over HTTP as it is an http.Handler, or
+// written to a file for the node_exporter textfile collector after
+// each operation.
+type Metrics struct {
+	mu              sync.Mutex
+	fileMu          sync.Mutex
+	file            string               // textfile to write the metrics to if set
+	uploadedBytes   int64                // bytes of chunks uploaded
+	downloadedBytes int64                // bytes of objects downloaded
+	chunkPuts       []int64              // chunk PUTs in each bucket, not cumulative
+	chunkPutSum     float64              // total seconds of chunk PUTs
+	chunkPutCount   int64                // number of chunk PUTs
+	operations      map[string]int64     // operations by name
+	failures        map[string]int64     // failed operations by name
+	retries         map[string]int64     // retries by operation name
+	listed          bool                 // set once the snapshots have been listed
+	snapshots       int                  // number of snapshots at the last list
+	storedBytes     int64                // bytes in the container at the last list
+	newest          map[string]time.Time // date of the newest snapshot by Miniserver
+}
+
+// newMetrics makes an empty Metrics which is written to file after
+// each operation if it is set
+func newMetrics(file string) *Metrics {
+	m := &Metrics{
+		file:       file,
+		chunkPuts:  make([]int64, len(chunkPutBuckets)+1),
+		operations: map[string]int64{},
+		failures:   map[string]int64{},
+		retries:    map[string]int64{},
+		newest:     map[string]time.Time{},
+	}
+	for _, op := range metricsOps {
+		m.operations[op] = 0
+		m.failures[op] = 0
+	}
+	for _, op := range metricsRetryOps {
+		m.retries[op] = 0
+	}
+	return m
+}
+
+// record counts the operation op which finished with err, then
+// writes the textfile if set
+func (m *Metrics) record(op string, err error) {
+	m.mu.Lock()
+	m.operations[op]++
+	if err != nil {
+		m.failures[op]++
+	}
+	m.mu.Unlock()
+	if m.file != "" {
+		writeErr := m.WriteFile(m.file)
+		if writeErr != nil {
+			log.Printf("Couldn't write metrics: %v", writeErr)
+		}
+	}
+}
+
+// retry counts n retries of the operation op
+func (m *Metrics) retry(op string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.retries[op] += int64(n)
+}
+
+// uploaded counts a chunk of n bytes uploaded in duration
+func (m *Metrics) uploaded(n int, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploadedBytes += int64(n)
+	seconds := duration.Seconds()
+	i := sort.SearchFloat64s(chunkPutBuckets, seconds)
+	m.chunkPuts[i]++
+	m.chunkPutSum += seconds
+	m.chunkPutCount++
+}
+
+// downloaded counts n bytes downloaded
+func (m *Metrics) downloaded(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.downloadedBytes += int64(n)
+}
+
+// listedSnapshots records the snapshots found by a list and the
+// bytes stored in the container
+func (m *Metrics) listedSnapshots(snapshots []*Snapshot, storedBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listed = true
+	m.snapshots = len(snapshots)
+	m.storedBytes = storedBytes
+	m.newest = map[string]time.Time{}
+	for _, s := range snapshots {
+		if s.Broken {
+			continue
+		}
+		if newest, ok := m.newest[s.Miniserver]; !ok || s.Date.After(newest) {
+			m.newest[s.Miniserver] = s.Date
+		}
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus text format
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+// header writes the HELP and TYPE lines of a metric
+func (mw *metricsWriter) header(name, metricType, help string) {
+	mw.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// value writes a sample of name with the label if set
+func (mw *metricsWriter) value(name, label, labelValue string, value float64) {
+	if label != "" {
+		name += fmt.Sprintf(`{%s="%s"}`, label, metricsLabel(labelValue))
+	}
+	mw.printf("%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// labelled writes a metric with a sample for each of values
+func (mw *metricsWriter) labelled(name, metricType, help, label string, values map[string]int64) {
+	mw.header(name, metricType, help)
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		mw.value(name, label, key, float64(values[key]))
+	}
+}
+
+// printf writes to the output remembering the first error
+func (mw *metricsWriter) printf(format string, args ...interface{}) {
+	if mw.err == nil {
+		_, mw.err = fmt.Fprintf(mw.w, format, args...)
+	}
+}
+
+// Write writes the metrics to w in the Prometheus text format
+func (m *Metrics) Write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.header("snapshot_manager_uploaded_bytes_total", "counter", "Bytes of image chunks uploaded.")
+	mw.value("snapshot_manager_uploaded_bytes_total", "", "", float64(m.uploadedBytes))
+	mw.header("snapshot_manager_downloaded_bytes_total", "counter", "Bytes of snapshot objects downloaded.")
+	mw.value("snapshot_manager_downloaded_bytes_total", "", "", float64(m.downloadedBytes))
+
+	const chunkPut = "snapshot_manager_chunk_put_seconds"
+	mw.header(chunkPut, "histogram", "Time taken to PUT each chunk of an image.")
+	count := int64(0)
+	for i, le := range chunkPutBuckets {
+		count += m.chunkPuts[i]
+		mw.value(chunkPut+"_bucket", "le", strconv.FormatFloat(le, 'g', -1, 64), float64(count))
+	}
+	mw.value(chunkPut+"_bucket", "le", "+Inf", float64(m.chunkPutCount))
+	mw.value(chunkPut+"_sum", "", "", m.chunkPutSum)
+	mw.value(chunkPut+"_count", "", "", float64(m.chunkPutCount))
+
+	mw.labelled("snapshot_manager_operations_total", "counter", "Operations run.", "op", m.operations)
+	mw.labelled("snapshot_manager_failures_total", "counter", "Operations which failed.", "op", m.failures)
+	mw.labelled("snapshot_manager_retries_total", "counter", "Retries of objects or connections.", "op", m.retries)
+
+	// Only report the snapshots once they have been counted
+	if m.listed {
+		mw.header("snapshot_manager_snapshots", "gauge", "Number of snapshots at the last list.")
+		mw.value("snapshot_manager_snapshots", "", "", float64(m.snapshots))
+		mw.header("snapshot_manager_stored_bytes", "gauge", "Bytes stored in the snapshot container at the last list.")
+		mw.value("snapshot_manager_stored_bytes", "", "", float64(m.storedBytes))
+		ages := map[string]int64{}
+		now := time.Now()
+		for miniserver, newest := range m.newest {
+			ages[miniserver] = int64(now.Sub(newest).Seconds())
+		}
+		mw.labelled("snapshot_manager_newest_snapshot_age_seconds", "gauge", "Age of the newest snapshot of each Miniserver.", "miniserver", ages)
+	}
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+// WriteFile writes the metrics to path for the node_exporter textfile
+// collector
+//
+// They are written to a temporary file which is renamed to path so
+// the collector never sees a partial file.
+func (m *Metrics) WriteFile(path string) error {
+	m.fileMu.Lock()
+	defer m.fileMu.Unlock()
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = m.Write(out)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := m.Write(w)
+	if err != nil {
+		log.Printf("Couldn't serve metrics: %v", err)
+	}
+}
+
+// metricsLabel makes a label value safe for the text format
+func metricsLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
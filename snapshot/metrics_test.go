@@ -0,0 +1,219 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMetrics parses the samples written by m into a map of the
+// metric with its labels to its value
+func readMetrics(t *testing.T, m *Metrics) map[string]float64 {
+	var buf bytes.Buffer
+	err := m.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := map[string]float64{}
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("bad sample %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad value in %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics("")
+	for _, d := range []time.Duration{
+		50 * time.Millisecond,
+		300 * time.Millisecond,
+		time.Second, // on a bucket boundary
+		7 * time.Second,
+		400 * time.Second, // above all the buckets
+	} {
+		m.uploaded(100, d)
+	}
+	samples := readMetrics(t, m)
+	want := map[string]float64{
+		"0.1": 1, "0.25": 1, "0.5": 2, "1": 3, "2.5": 3, "5": 3,
+		"10": 4, "30": 4, "60": 4, "120": 4, "300": 4, "+Inf": 5,
+	}
+	previous := 0.0
+	for _, le := range chunkPutBuckets {
+		key := strconv.FormatFloat(le, 'g', -1, 64)
+		got := samples[`snapshot_manager_chunk_put_seconds_bucket{le="`+key+`"}`]
+		if got != want[key] {
+			t.Errorf("bucket le=%s got %v want %v", key, got, want[key])
+		}
+		if got < previous {
+			t.Errorf("bucket le=%s isn't cumulative: %v < %v", key, got, previous)
+		}
+		previous = got
+	}
+	inf := samples[`snapshot_manager_chunk_put_seconds_bucket{le="+Inf"}`]
+	count := samples["snapshot_manager_chunk_put_seconds_count"]
+	if inf != 5 || count != inf {
+		t.Errorf("+Inf bucket %v and count %v want 5", inf, count)
+	}
+	if got, want := samples["snapshot_manager_chunk_put_seconds_sum"], 408.35; got < want-1e-9 || got > want+1e-9 {
+		t.Errorf("sum %v want %v", got, want)
+	}
+	if got := samples["snapshot_manager_uploaded_bytes_total"]; got != 500 {
+		t.Errorf("uploaded %v bytes want 500", got)
+	}
+}
+
+func TestMetricsOperations(t *testing.T) {
+	m := newMetrics("")
+	m.record("upload", nil)
+	m.record("upload", errors.New("boom"))
+	m.record("delete", nil)
+	m.retry("delete", 3)
+	m.downloaded(42)
+	samples := readMetrics(t, m)
+	for key, want := range map[string]float64{
+		`snapshot_manager_operations_total{op="upload"}`: 2,
+		`snapshot_manager_operations_total{op="delete"}`: 1,
+		`snapshot_manager_operations_total{op="list"}`:   0,
+		`snapshot_manager_failures_total{op="upload"}`:   1,
+		`snapshot_manager_failures_total{op="delete"}`:   0,
+		`snapshot_manager_retries_total{op="delete"}`:    3,
+		`snapshot_manager_retries_total{op="import"}`:    0,
+		`snapshot_manager_downloaded_bytes_total`:        42,
+	} {
+		got, ok := samples[key]
+		if !ok || got != want {
+			t.Errorf("%s = %v, %v want %v", key, got, ok, want)
+		}
+	}
+	// The snapshot gauges only appear once listed
+	if _, ok := samples["snapshot_manager_snapshots"]; ok {
+		t.Errorf("snapshot gauges reported before listing")
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+	}{
+		{`web1`, `web1`},
+		{`back\slash`, `back\\slash`},
+		{`"quoted"`, `\"quoted\"`},
+		{"new\nline", `new\nline`},
+		{"all\\\"\n", `all\\\"\n`},
+	} {
+		if got := metricsLabel(test.in); got != test.want {
+			t.Errorf("metricsLabel(%q) = %q want %q", test.in, got, test.want)
+		}
+	}
+
+	m := newMetrics("")
+	now := time.Now()
+	m.listedSnapshots([]*Snapshot{
+		{Miniserver: "a\"b\\c\nd", Date: now.Add(-time.Hour)},
+		{Miniserver: "web1", Date: now.Add(-3 * time.Hour)},
+		{Miniserver: "web1", Date: now.Add(-2 * time.Hour)},
+		{Miniserver: "web2", Date: now, Broken: true},
+	}, 1234)
+	samples := readMetrics(t, m)
+	if got := samples["snapshot_manager_snapshots"]; got != 4 {
+		t.Errorf("snapshots %v want 4", got)
+	}
+	if got := samples["snapshot_manager_stored_bytes"]; got != 1234 {
+		t.Errorf("stored bytes %v want 1234", got)
+	}
+	for key, want := range map[string]float64{
+		`snapshot_manager_newest_snapshot_age_seconds{miniserver="a\"b\\c\nd"}`: 3600,
+		`snapshot_manager_newest_snapshot_age_seconds{miniserver="web1"}`:       7200,
+	} {
+		got, ok := samples[key]
+		if !ok || got < want || got > want+5 {
+			t.Errorf("%s = %v, %v want %v", key, got, ok, want)
+		}
+	}
+	if _, ok := samples[`snapshot_manager_newest_snapshot_age_seconds{miniserver="web2"}`]; ok {
+		t.Errorf("broken snapshot counted as newest")
+	}
+}
+
+func TestMetricsWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	file := filepath.Join(dir, "snapshot-manager.prom")
+	m := newMetrics(file)
+	m.record("upload", nil)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `snapshot_manager_operations_total{op="upload"} 1`) {
+		t.Errorf("metrics file doesn't have the upload:\n%s", data)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestManagerListMetrics(t *testing.T) {
+	sm, _ := newTestManager(t)
+	ok, err := sm.Check()
+	if err != nil || ok {
+		t.Fatalf("Check on missing container = %v, %v", ok, err)
+	}
+	snapshots, err := sm.List()
+	if err != nil || len(snapshots) != 0 {
+		t.Fatalf("List on missing container = %v, %v", snapshots, err)
+	}
+	if got := readMetrics(t, sm.Metrics)["snapshot_manager_snapshots"]; got != 0 {
+		t.Errorf("snapshots %v want 0", got)
+	}
+
+	s := sm.NewSnapshotForUpload("myacc.2026-02-01-12-00-00", "image.tar")
+	err = s.PutStream(bytes.NewReader(testImage(250000)), 250000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err = sm.Check()
+	if err != nil || !ok {
+		t.Fatalf("Check = %v, %v", ok, err)
+	}
+	snapshots, err = sm.List()
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("List = %v, %v", snapshots, err)
+	}
+	samples := readMetrics(t, sm.Metrics)
+	if got := samples["snapshot_manager_snapshots"]; got != 1 {
+		t.Errorf("snapshots %v want 1", got)
+	}
+	if got := samples["snapshot_manager_stored_bytes"]; got < 250000 {
+		t.Errorf("stored bytes %v want at least 250000", got)
+	}
+	if got := samples[`snapshot_manager_operations_total{op="list"}`]; got != 2 {
+		t.Errorf("lists %v want 2", got)
+	}
+	if got := samples["snapshot_manager_chunk_put_seconds_count"]; got != 3 {
+		t.Errorf("chunk PUTs %v want 3", got)
+	}
+}
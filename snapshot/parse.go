@@ -0,0 +1,47 @@
+package snapshot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Date formats accepted by ParseDate
+var dateFormats = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	DirectoryDate,
+	"2006-01-02",
+}
+
+// ParseDate parses a date given by the user in one of several
+// formats, eg "2015-06-01" or "2015-06-01T12:00:00".  Dates without a
+// time zone are in local time.
+func ParseDate(date string) (time.Time, error) {
+	for _, format := range dateFormats {
+		t, err := time.ParseInLocation(format, date, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("couldn't parse date %q - use YYYY-MM-DD or YYYY-MM-DDTHH:MM:SS", date)
+}
+
+// ParseDuration parses a duration given by the user.  As well as
+// the units time.ParseDuration accepts it accepts a "d" suffix for
+// days, eg "7d" or "30d".
+func ParseDuration(duration string) (time.Duration, error) {
+	if strings.HasSuffix(duration, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(duration, "d"), 64)
+		if err == nil {
+			return time.Duration(days * float64(24*time.Hour)), nil
+		}
+	}
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse duration %q - use eg 7d or 12h", duration)
+	}
+	return d, nil
+}
@@ -0,0 +1,172 @@
+package snapshot
+
+import (
+	"strings"
+)
+
+// README.txt keys which are parsed into Snapshot fields
+var readmeKnownKeys = map[string]bool{
+	"user_comment":               true,
+	"date":                       true,
+	"miniserver":                 true,
+	"image_type":                 true,
+	"snapshot_image":             true,
+	"md5(snapshot_image)":        true,
+	"sha256(snapshot_image)":     true,
+	"disk_size":                  true,
+	"encryption":                 true,
+	"encryption_kdf":             true,
+	"encryption_key_fingerprint": true,
+}
+
+// Readme is a parsed README.txt
+//
+// It keeps all the lines of the original including the comments and
+// the order of the keys so that it can be written back out without
+// losing anything.  Only the lines whose values are changed are
+// rewritten.
+type Readme struct {
+	lines []readmeLine
+}
+
+// readmeLine is a single line of the README.txt
+type readmeLine struct {
+	text  string // the line as it will be written out
+	key   string // the key if this is a key = value line
+	value string // the value if this is a key = value line
+}
+
+// NewReadme parses the text of a README.txt
+//
+// Lines of the form "key = value" are keys, lines starting with ";"
+// are comments and all other lines are kept as they are.
+func NewReadme(text string) *Readme {
+	r := &Readme{}
+	for _, line := range strings.Split(text, "\n") {
+		l := readmeLine{text: line}
+		if !strings.HasPrefix(strings.TrimSpace(line), ";") && strings.Contains(line, "=") {
+			tokens := strings.SplitN(line, "=", 2)
+			l.key = strings.TrimSpace(tokens[0])
+			l.value = strings.TrimSpace(tokens[1])
+		}
+		r.lines = append(r.lines, l)
+	}
+	return r
+}
+
+// String returns the README.txt as text
+func (r *Readme) String() string {
+	lines := make([]string, len(r.lines))
+	for i, l := range r.lines {
+		lines[i] = l.text
+	}
+	return strings.Join(lines, "\n")
+}
+
+// matches returns whether the line has the key, ignoring case
+func (l *readmeLine) matches(key string) bool {
+	return l.key != "" && strings.EqualFold(l.key, key)
+}
+
+// Get returns the value of key, ignoring case, and whether it was
+// found.  If the key appears more than once the last value is used.
+func (r *Readme) Get(key string) (value string, ok bool) {
+	for i := range r.lines {
+		if r.lines[i].matches(key) {
+			value, ok = r.lines[i].value, true
+		}
+	}
+	return value, ok
+}
+
+// crlf returns whether the README.txt has Windows line endings
+func (r *Readme) crlf() bool {
+	for _, l := range r.lines {
+		if strings.HasSuffix(l.text, "\r") {
+			return true
+		}
+	}
+	return false
+}
+
+// Set sets key to value, ignoring case.  Lines which already have the
+// value are left unchanged, otherwise they are rewritten keeping their
+// line ending.  If the key isn't found it is added to the end.
+func (r *Readme) Set(key, value string) {
+	found := false
+	for i := range r.lines {
+		l := &r.lines[i]
+		if !l.matches(key) {
+			continue
+		}
+		found = true
+		if l.value != value {
+			cr := ""
+			if strings.HasSuffix(l.text, "\r") {
+				cr = "\r"
+			}
+			l.value = value
+			l.text = l.key + " = " + value + cr
+		}
+	}
+	if found {
+		return
+	}
+	l := readmeLine{
+		text:  key + " = " + value,
+		key:   key,
+		value: value,
+	}
+	// Add before any trailing blank lines
+	i := len(r.lines)
+	for i > 0 && strings.TrimSuffix(r.lines[i-1].text, "\r") == "" {
+		i--
+	}
+	if r.crlf() {
+		if i < len(r.lines) {
+			l.text += "\r"
+		} else if i > 0 {
+			// the new line is last so the one before needs an ending
+			r.lines[i-1].text += "\r"
+		}
+	}
+	r.lines = append(r.lines, readmeLine{})
+	copy(r.lines[i+1:], r.lines[i:])
+	r.lines[i] = l
+}
+
+// Delete removes all the lines with key, ignoring case
+func (r *Readme) Delete(key string) {
+	lines := r.lines[:0]
+	for _, l := range r.lines {
+		if !l.matches(key) {
+			lines = append(lines, l)
+		}
+	}
+	r.lines = lines
+}
+
+// Keys returns the keys in the order they appear
+func (r *Readme) Keys() []string {
+	var keys []string
+	for _, l := range r.lines {
+		if l.key != "" {
+			keys = append(keys, l.key)
+		}
+	}
+	return keys
+}
+
+// Unknown returns the keys which aren't parsed into Snapshot fields
+// or tags and their values
+func (r *Readme) Unknown() map[string]string {
+	unknown := map[string]string{}
+	for _, l := range r.lines {
+		lower := strings.ToLower(l.key)
+		if l.key == "" || readmeKnownKeys[lower] || strings.HasPrefix(lower, ReadmeTagPrefix) {
+			continue
+		}
+		unknown[l.key] = l.value
+	}
+	return unknown
+}
@@ -0,0 +1,333 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A README.txt as written by the Memset control panel
+const readmeControlPanel = `; This directory contains a virtual machine disk image snapshot.
+; The files in this directory are described below.
+; For more information see: http://www.memset.com/docs/
+;
+date = 2012-08-21T17:08:27.391967
+miniserver = myaccaa1
+user_comment = A real snapshot
+image_type = Tarball file
+snapshot_image = myaccaa1.tar
+md5(snapshot_image) = 3350b64f1b48cc2f3a10d6fda6b18b43
+disk_size = 42949672960
+`
+
+// A README.txt with keys snapshot-manager doesn't model, blank lines,
+// odd spacing and a repeated key
+const readmeUnknownKeys = `; This directory contains a virtual machine disk image snapshot.
+; The files in this directory are described below.
+; For more information see: http://www.memset.com/docs/
+;
+
+date = 2015-01-08T15:44:16.695676
+miniserver = myaccaa2
+user_comment = Before the upgrade
+virtualisation = hvm
+image_type = gzipped Raw file
+snapshot_image=myaccaa2.raw.gz
+md5(snapshot_image) = 91c1a3ca4e4b1e8a1b7d0a2d4d7e55b1
+disk_size = 21474836480
+kernel = pv-grub-x86_64
+kernel = pvh-grub-x86_64
+
+; Added by support
+ticket   =   MS-12345
+`
+
+// A README.txt with Windows line endings and no final newline
+const readmeCRLF = "; This directory contains a virtual machine disk image snapshot.\r\n" +
+	"date = 2014-03-02T09:01:02.5\r\n" +
+	"miniserver = myaccaa3\r\n" +
+	"image_type = gzipped NTFS Image file\r\n" +
+	"snapshot_image = myaccaa3.xmbr\r\n" +
+	"backup_window = 02:00-04:00"
+
+var readmeSamples = map[string]string{
+	"control panel": readmeControlPanel,
+	"unknown keys":  readmeUnknownKeys,
+	"crlf":          readmeCRLF,
+	"empty":         "",
+	"comments only": "; nothing here\n;\n\n",
+}
+
+func TestReadmeRoundTrip(t *testing.T) {
+	for name, sample := range readmeSamples {
+		got := NewReadme(sample).String()
+		if got != sample {
+			t.Errorf("%s: round trip changed README.txt\ngot  %q\nwant %q", name, got, sample)
+		}
+	}
+}
+
+func TestReadmeGet(t *testing.T) {
+	r := NewReadme(readmeUnknownKeys)
+	for _, test := range []struct {
+		key   string
+		value string
+		ok    bool
+	}{
+		{"miniserver", "myaccaa2", true},
+		{"MINISERVER", "myaccaa2", true},
+		{"snapshot_image", "myaccaa2.raw.gz", true},
+		{"kernel", "pvh-grub-x86_64", true}, // last one wins
+		{"ticket", "MS-12345", true},
+		{"missing", "", false},
+		{"; Added by support", "", false},
+	} {
+		value, ok := r.Get(test.key)
+		if value != test.value || ok != test.ok {
+			t.Errorf("Get(%q) = %q, %v want %q, %v", test.key, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestReadmeKeys(t *testing.T) {
+	got := NewReadme(readmeUnknownKeys).Keys()
+	want := []string{"date", "miniserver", "user_comment", "virtualisation", "image_type", "snapshot_image", "md5(snapshot_image)", "disk_size", "kernel", "kernel", "ticket"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %q want %q", got, want)
+	}
+}
+
+func TestReadmeSet(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		in    string
+		key   string
+		value string
+		want  string
+	}{
+		{
+			name:  "known key",
+			in:    "; comment\ndate = 1\nminiserver = a\nuser_comment = x\n",
+			key:   "miniserver",
+			value: "b",
+			want:  "; comment\ndate = 1\nminiserver = b\nuser_comment = x\n",
+		},
+		{
+			name:  "unknown key",
+			in:    "date = 1\nticket   =   MS-1\nminiserver = a\n",
+			key:   "ticket",
+			value: "MS-2",
+			want:  "date = 1\nticket = MS-2\nminiserver = a\n",
+		},
+		{
+			name:  "same value leaves spacing alone",
+			in:    "date = 1\nsnapshot_image=a.tar\n",
+			key:   "SNAPSHOT_IMAGE",
+			value: "a.tar",
+			want:  "date = 1\nsnapshot_image=a.tar\n",
+		},
+		{
+			name:  "repeated key",
+			in:    "kernel = a\ndate = 1\nkernel = b\n",
+			key:   "kernel",
+			value: "c",
+			want:  "kernel = c\ndate = 1\nkernel = c\n",
+		},
+		{
+			name:  "new key goes before trailing blank lines",
+			in:    "; comment\ndate = 1\n\n",
+			key:   "tag_env",
+			value: "prod",
+			want:  "; comment\ndate = 1\ntag_env = prod\n\n",
+		},
+		{
+			name:  "new key without final newline",
+			in:    "date = 1",
+			key:   "disk_size",
+			value: "10",
+			want:  "date = 1\ndisk_size = 10",
+		},
+		{
+			name:  "crlf",
+			in:    "date = 1\r\nminiserver = a\r\n",
+			key:   "miniserver",
+			value: "b",
+			want:  "date = 1\r\nminiserver = b\r\n",
+		},
+		{
+			name:  "new key crlf",
+			in:    "date = 1\r\n\r\n",
+			key:   "disk_size",
+			value: "10",
+			want:  "date = 1\r\ndisk_size = 10\r\n\r\n",
+		},
+		{
+			name:  "new key crlf without final newline",
+			in:    "date = 1\r\nminiserver = a",
+			key:   "disk_size",
+			value: "10",
+			want:  "date = 1\r\nminiserver = a\r\ndisk_size = 10",
+		},
+	} {
+		r := NewReadme(test.in)
+		r.Set(test.key, test.value)
+		if got := r.String(); got != test.want {
+			t.Errorf("%s: got %q want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadmeDelete(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		in   string
+		key  string
+		want string
+	}{
+		{
+			name: "known key",
+			in:   "; comment\ndate = 1\nmd5(snapshot_image) = abc\ndisk_size = 10\n",
+			key:  "md5(snapshot_image)",
+			want: "; comment\ndate = 1\ndisk_size = 10\n",
+		},
+		{
+			name: "unknown key",
+			in:   "date = 1\n\nticket = MS-1\n; after\nminiserver = a\n",
+			key:  "Ticket",
+			want: "date = 1\n\n; after\nminiserver = a\n",
+		},
+		{
+			name: "repeated key",
+			in:   "kernel = a\ndate = 1\nkernel = b\n",
+			key:  "kernel",
+			want: "date = 1\n",
+		},
+		{
+			name: "missing key",
+			in:   "date = 1\n",
+			key:  "miniserver",
+			want: "date = 1\n",
+		},
+	} {
+		r := NewReadme(test.in)
+		r.Delete(test.key)
+		if got := r.String(); got != test.want {
+			t.Errorf("%s: got %q want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadmeUnknown(t *testing.T) {
+	for name, want := range map[string]map[string]string{
+		"control panel": {},
+		"unknown keys": {
+			"virtualisation": "hvm",
+			"kernel":         "pvh-grub-x86_64",
+			"ticket":         "MS-12345",
+		},
+		"crlf": {
+			"backup_window": "02:00-04:00",
+		},
+		"empty": {},
+	} {
+		got := NewReadme(readmeSamples[name]).Unknown()
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Unknown() = %q want %q", name, got, want)
+		}
+	}
+	// tags and the keys added by snapshot-manager are modelled
+	r := NewReadme("tag_env = prod\nsha256(snapshot_image) = ab\nencryption = x\nencryption_kdf = y\nencryption_key_fingerprint = z\n")
+	if got := r.Unknown(); len(got) != 0 {
+		t.Errorf("Unknown() = %q want none", got)
+	}
+}
+
+func TestCreateReadmeKeepsLayout(t *testing.T) {
+	s := &Snapshot{Name: "myacc.2015-01-08-15-44-16"}
+	err := s.ParseReadme(readmeUnknownKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Comment = "After the upgrade"
+	s.DiskSize = 0
+	err = s.SetTag("env", "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Extra["ticket"] = "MS-54321"
+	s.CreateReadme()
+	want := `; This directory contains a virtual machine disk image snapshot.
+; The files in this directory are described below.
+; For more information see: http://www.memset.com/docs/
+;
+
+date = 2015-01-08T15:44:16.695676
+miniserver = myaccaa2
+user_comment = After the upgrade
+virtualisation = hvm
+image_type = gzipped Raw file
+snapshot_image=myaccaa2.raw.gz
+md5(snapshot_image) = 91c1a3ca4e4b1e8a1b7d0a2d4d7e55b1
+kernel = pv-grub-x86_64
+kernel = pvh-grub-x86_64
+
+; Added by support
+ticket = MS-54321
+tag_env = prod
+`
+	if s.ReadMe != want {
+		t.Errorf("CreateReadme got\n%s\nwant\n%s", s.ReadMe, want)
+	}
+
+	// Reading it back gives the same snapshot
+	s2 := &Snapshot{}
+	err = s2.ParseReadme(s.ReadMe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Comment != s.Comment || s2.Miniserver != "myaccaa2" || !s2.Date.Equal(s.Date) || s2.Tags["env"] != "prod" || !reflect.DeepEqual(s2.Extra, s.Extra) {
+		t.Errorf("re-parsed snapshot differs: %+v", s2)
+	}
+}
+
+func TestCreateReadmeEmptyValues(t *testing.T) {
+	const in = "date = 2015-01-08T15:44:16.695676\r\n" +
+		"miniserver = myaccaa2\r\n" +
+		"user_comment =\r\n" +
+		"notes =\r\n" +
+		"ticket = MS-1\r\n"
+	s := &Snapshot{}
+	err := s.ParseReadme(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CreateReadme()
+	if s.ReadMe != in {
+		t.Errorf("CreateReadme dropped empty values\ngot  %q\nwant %q", s.ReadMe, in)
+	}
+
+	// Clearing a value deletes it, setting one keeps the line ending
+	s.Miniserver = ""
+	delete(s.Extra, "ticket")
+	s.Comment = "Before the upgrade"
+	s.CreateReadme()
+	want := "date = 2015-01-08T15:44:16.695676\r\n" +
+		"user_comment = Before the upgrade\r\n" +
+		"notes =\r\n"
+	if s.ReadMe != want {
+		t.Errorf("CreateReadme got %q want %q", s.ReadMe, want)
+	}
+}
+
+func TestCreateReadmeUnchanged(t *testing.T) {
+	for name, sample := range readmeSamples {
+		s := &Snapshot{}
+		_ = s.ParseReadme(sample)
+		if name == "empty" || name == "comments only" {
+			continue
+		}
+		s.CreateReadme()
+		if s.ReadMe != sample {
+			t.Errorf("%s: CreateReadme changed an unedited README.txt\ngot  %q\nwant %q", name, s.ReadMe, sample)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package snapshot
+
+import (
+	"sort"
+	"time"
+)
+
+// Retention says which snapshots of each Miniserver to keep
+type Retention struct {
+	Keep   int           // number of the newest snapshots to keep or 0 for any number
+	MaxAge time.Duration // age after which snapshots are deleted or 0 for any age
+}
+
+// IsSet returns whether any retention rules are set
+func (r Retention) IsSet() bool {
+	return r.Keep > 0 || r.MaxAge > 0
+}
+
+// Expired returns the snapshots the retention rules say should be
+// deleted at now
+//
+// The rules are applied to the snapshots of each Miniserver
+// separately.  The newest snapshot of each Miniserver is always kept
+// whatever its age, and broken snapshots are left for fsck to deal
+// with.
+func (r Retention) Expired(snapshots []*Snapshot, now time.Time) []*Snapshot {
+	if !r.IsSet() {
+		return nil
+	}
+	byMiniserver := map[string][]*Snapshot{}
+	for _, s := range snapshots {
+		if s.Broken {
+			continue
+		}
+		byMiniserver[s.Miniserver] = append(byMiniserver[s.Miniserver], s)
+	}
+	var miniservers []string
+	for miniserver := range byMiniserver {
+		miniservers = append(miniservers, miniserver)
+	}
+	sort.Strings(miniservers)
+	var expired []*Snapshot
+	for _, miniserver := range miniservers {
+		group := byMiniserver[miniserver]
+		_ = Sort(group, "date", true)
+		for i, s := range group {
+			switch {
+			case i == 0:
+			case r.Keep > 0 && i >= r.Keep:
+				expired = append(expired, s)
+			case r.MaxAge > 0 && now.Sub(s.Date) > r.MaxAge:
+				expired = append(expired, s)
+			}
+		}
+	}
+	return expired
+}
@@ -0,0 +1,87 @@
+package snapshot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Date(2026, 2, 1, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	// snap makes a snapshot of miniserver days old
+	snap := func(name, miniserver string, days int) *Snapshot {
+		return &Snapshot{
+			Name:       name,
+			Miniserver: miniserver,
+			Date:       now.Add(-time.Duration(days) * day),
+		}
+	}
+	broken := func(s *Snapshot) *Snapshot {
+		s.Broken = true
+		return s
+	}
+	for _, test := range []struct {
+		name      string
+		retention Retention
+		snapshots []*Snapshot
+		want      []string
+	}{
+		{
+			name:      "not set",
+			retention: Retention{},
+			snapshots: []*Snapshot{snap("a", "web1", 100), snap("b", "web1", 1)},
+			want:      nil,
+		},
+		{
+			name:      "keep",
+			retention: Retention{Keep: 2},
+			snapshots: []*Snapshot{snap("a", "web1", 3), snap("b", "web1", 1), snap("c", "web1", 4), snap("d", "web1", 2)},
+			want:      []string{"a", "c"},
+		},
+		{
+			name:      "max age",
+			retention: Retention{MaxAge: 7 * day},
+			snapshots: []*Snapshot{snap("a", "web1", 1), snap("b", "web1", 5), snap("c", "web1", 10), snap("d", "web1", 20)},
+			want:      []string{"c", "d"},
+		},
+		{
+			name:      "keep and max age",
+			retention: Retention{Keep: 3, MaxAge: 7 * day},
+			snapshots: []*Snapshot{snap("a", "web1", 1), snap("b", "web1", 5), snap("c", "web1", 10), snap("d", "web1", 20), snap("e", "web1", 30)},
+			want:      []string{"c", "d", "e"},
+		},
+		{
+			name:      "keep stricter than max age",
+			retention: Retention{Keep: 1, MaxAge: 30 * day},
+			snapshots: []*Snapshot{snap("a", "web1", 1), snap("b", "web1", 2), snap("c", "web1", 3)},
+			want:      []string{"b", "c"},
+		},
+		{
+			name:      "newest always kept",
+			retention: Retention{MaxAge: day},
+			snapshots: []*Snapshot{snap("a", "web1", 10), snap("b", "web1", 5)},
+			want:      []string{"a"},
+		},
+		{
+			name:      "broken skipped",
+			retention: Retention{Keep: 1, MaxAge: day},
+			snapshots: []*Snapshot{broken(snap("a", "web1", 0)), snap("b", "web1", 10), broken(snap("c", "web1", 50)), snap("d", "web1", 20)},
+			want:      []string{"d"},
+		},
+		{
+			name:      "each miniserver separately",
+			retention: Retention{Keep: 1},
+			snapshots: []*Snapshot{snap("a", "web1", 1), snap("b", "db1", 2), snap("c", "web1", 3), snap("d", "db1", 1)},
+			want:      []string{"b", "c"},
+		},
+	} {
+		var got []string
+		for _, s := range test.retention.Expired(test.snapshots, now) {
+			got = append(got, s.Name)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expired %q want %q", test.name, got, test.want)
+		}
+	}
+}
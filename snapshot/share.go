@@ -0,0 +1,79 @@
+package snapshot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+// Account metadata header holding the key TempURLs are signed with
+const tempUrlKeyHeader = "X-Account-Meta-Temp-Url-Key"
+
+// TempUrl is a temporary URL to download an object of a snapshot
+// without credentials
+type TempUrl struct {
+	Leaf    string    // leaf name of the object
+	Url     string    // the signed URL
+	Expires time.Time // when the URL stops working
+}
+
+// TempUrlKey returns the Temp-URL-Key of the account
+//
+// If key is set and differs from the one on the account then the
+// account is updated with it, which stops any URLs made with the old
+// key working.  If key is empty and the account doesn't have one then
+// a random one is made and set.
+func (sm *Manager) TempUrlKey(key string) (string, error) {
+	_, headers, err := sm.Swift.Account()
+	if err != nil {
+		return "", fmt.Errorf("failed to read account: %v", err)
+	}
+	current := headers[tempUrlKeyHeader]
+	if key == "" {
+		if current != "" {
+			return current, nil
+		}
+		buf := make([]byte, 32)
+		_, err = rand.Read(buf)
+		if err != nil {
+			return "", fmt.Errorf("failed to make Temp-URL-Key: %v", err)
+		}
+		key = hex.EncodeToString(buf)
+		log.Printf("Setting a new Temp-URL-Key on the account")
+	} else if key == current {
+		return key, nil
+	} else if current != "" {
+		log.Printf("Replacing the Temp-URL-Key on the account - URLs made with the old key will stop working")
+	}
+	err = sm.Swift.AccountUpdate(swift.Headers{tempUrlKeyHeader: key})
+	if err != nil {
+		return "", fmt.Errorf("failed to set Temp-URL-Key: %v", err)
+	}
+	return key, nil
+}
+
+// Share makes TempURLs signed with key to download the image and the
+// README.txt of the snapshot which work for the duration expires
+func (s *Snapshot) Share(key string, expires time.Duration) ([]TempUrl, error) {
+	if s.Broken || s.Path == "" {
+		return nil, fmt.Errorf("snapshot %q is broken - nothing to share", s.Name)
+	}
+	if expires <= 0 {
+		return nil, fmt.Errorf("expiry %v must be positive", expires)
+	}
+	expiresAt := time.Now().Add(expires)
+	var urls []TempUrl
+	for _, objectPath := range []string{s.Path, s.Name + "/README.txt"} {
+		urls = append(urls, TempUrl{
+			Leaf:    path.Base(objectPath),
+			Url:     s.Manager.Swift.ObjectTempUrl(s.Manager.Container, objectPath, key, "GET", expiresAt),
+			Expires: expiresAt,
+		})
+	}
+	return urls, nil
+}
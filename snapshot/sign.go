@@ -0,0 +1,150 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/ncw/swift"
+)
+
+// Signatures
+//
+// A snapshot is signed by storing a detached ed25519 signature of its
+// README.txt in the SignatureLeaf object next to it.  As the
+// README.txt contains the name, MD5 and size of the image, checking
+// the signature and then the MD5 proves the image is the one that
+// was signed.
+//
+// The signature object is a single line
+//
+//	ed25519 <key id> <base64 signature>
+const (
+	// Name of the object holding the signature of the README.txt
+	SignatureLeaf = "README.txt.sig"
+
+	signatureAlgorithm = "ed25519"
+)
+
+// LoadSigningKey reads an ed25519 private key from a PEM file as
+// made by "openssl genpkey -algorithm ed25519"
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	der, err := readPem(file, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %q: %v", file, err)
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("private key %q isn't an ed25519 key", file)
+	}
+	return privateKey, nil
+}
+
+// LoadPublicKey reads an ed25519 public key from a PEM file as made
+// by "openssl pkey -pubout"
+func LoadPublicKey(file string) (ed25519.PublicKey, error) {
+	der, err := readPem(file, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key %q: %v", file, err)
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key %q isn't an ed25519 key", file)
+	}
+	return publicKey, nil
+}
+
+// readPem reads the first PEM block of type blockType from file
+func readPem(file, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %s found in %q", blockType, file)
+		}
+		if block.Type == blockType {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// signingKeyId returns a short identifier for the public key
+func signingKeyId(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// signatureObject returns the name of the signature object
+func (s *Snapshot) signatureObject() string {
+	return s.Name + "/" + SignatureLeaf
+}
+
+// Sign signs the README.txt of the snapshot with privateKey and
+// uploads the signature
+func (s *Snapshot) Sign(privateKey ed25519.PrivateKey) error {
+	if s.ReadMe == "" {
+		return fmt.Errorf("snapshot %q has no README.txt to sign", s.Name)
+	}
+	keyId := signingKeyId(privateKey.Public().(ed25519.PublicKey))
+	signature := ed25519.Sign(privateKey, []byte(s.ReadMe))
+	contents := fmt.Sprintf("%s %s %s\n", signatureAlgorithm, keyId, base64.StdEncoding.EncodeToString(signature))
+	log.Printf("Signing README.txt with key %s", keyId)
+	_, err := s.Manager.Swift.ObjectPut(s.Manager.Container, s.signatureObject(), strings.NewReader(contents), true, "", "text/plain", s.expiryHeaders())
+	if err != nil {
+		return fmt.Errorf("failed to upload signature: %v", err)
+	}
+	return nil
+}
+
+// VerifySignature checks the README.txt of the snapshot was signed
+// by the private key belonging to publicKey
+func (s *Snapshot) VerifySignature(publicKey ed25519.PublicKey) error {
+	if s.ReadMe == "" {
+		return errors.New("README.txt missing or empty")
+	}
+	var buf bytes.Buffer
+	_, err := s.Manager.Swift.ObjectGet(s.Manager.Container, s.signatureObject(), &buf, true, nil)
+	if err == swift.ObjectNotFound {
+		return errors.New("snapshot isn't signed")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read signature: %v", err)
+	}
+	fields := strings.Fields(buf.String())
+	if len(fields) != 3 || fields[0] != signatureAlgorithm {
+		return fmt.Errorf("bad signature %q", strings.TrimSpace(buf.String()))
+	}
+	keyId := signingKeyId(publicKey)
+	if fields[1] != keyId {
+		return fmt.Errorf("signed by key %s not %s", fields[1], keyId)
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %v", err)
+	}
+	if !ed25519.Verify(publicKey, []byte(s.ReadMe), signature) {
+		return errors.New("signature doesn't match README.txt - it has been changed since it was signed")
+	}
+	return nil
+}
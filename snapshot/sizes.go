@@ -0,0 +1,36 @@
+package snapshot
+
+import (
+	"fmt"
+
+	"github.com/ncw/swift"
+)
+
+// ReadSizes reads how much storage the snapshot uses, setting
+// StoredSize and Chunks
+func (s *Snapshot) ReadSizes() error {
+	objects, err := s.Manager.Swift.ObjectsAll(s.Manager.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
+	}
+	s.StoredSize = 0
+	s.Chunks = 0
+	for _, object := range objects {
+		s.StoredSize += object.Bytes
+		if isChunk(object.Name) {
+			s.Chunks++
+		}
+	}
+	return nil
+}
+
+// Ratio returns the compression ratio of the snapshot - the disk
+// size divided by the stored size.  It returns 0 if either is unknown.
+func (s *Snapshot) Ratio() float64 {
+	if s.DiskSize == 0 || s.StoredSize == 0 {
+		return 0
+	}
+	return float64(s.DiskSize) / float64(s.StoredSize)
+}
@@ -6,12 +6,13 @@ package snapshot
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -27,6 +28,10 @@ const (
 	DirectoryDate = "2006-01-02-15-04-05"
 	// Python date format as used in the README.txt
 	ReadmeDateFormat = "2006-01-02T15:04:05.999999999"
+	// Default gzip compression level for uploads
+	DefaultCompressLevel = 6
+	// Prefix of the README.txt keys used for tags
+	ReadmeTagPrefix = "tag_"
 )
 
 // Describes a snapshot
@@ -42,7 +47,17 @@ type Snapshot struct {
 	ImageType  string
 	ImageLeaf  string
 	Md5        string
+	Sha256     string
 	DiskSize   int64
+	ExpireAt   time.Time         // when the snapshot will be deleted if set
+	StoredSize int64             // bytes stored in Memstore - set by ReadSizes
+	Chunks     int               // number of chunks - set by ReadSizes
+	Tags       map[string]string // user tags
+	Extra      map[string]string // README.txt keys not understood
+	Encryption string            // encryption scheme if the image is encrypted
+	KeyKdf     string            // how the encryption key was made
+	KeyId      string            // fingerprint of the encryption key
+	readme     *Readme           // parsed README.txt
 }
 
 // Return whether the snapshot exists
@@ -85,29 +100,81 @@ func (s *Snapshot) List() {
 	if s.Md5 != "" {
 		fmt.Printf("  Md5        - %s\n", s.Md5)
 	}
+	if s.Sha256 != "" {
+		fmt.Printf("  Sha256     - %s\n", s.Sha256)
+	}
 	if s.DiskSize != 0 {
 		fmt.Printf("  DiskSize   - %d\n", s.DiskSize)
 	}
+	if s.Encryption != "" {
+		fmt.Printf("  Encrypted  - %s key %s - not usable by the Memset control panel\n", s.Encryption, s.KeyId)
+	}
+	if !s.ExpireAt.IsZero() {
+		fmt.Printf("  ExpireAt   - %s\n", s.ExpireAt)
+	}
+	if s.StoredSize != 0 {
+		fmt.Printf("  StoredSize - %d\n", s.StoredSize)
+	}
+	if s.Chunks != 0 {
+		fmt.Printf("  Chunks     - %d\n", s.Chunks)
+	}
+	if ratio := s.Ratio(); ratio != 0 {
+		fmt.Printf("  Ratio      - %.2f\n", ratio)
+	}
+	for _, key := range sortedKeys(s.Tags) {
+		fmt.Printf("  Tag        - %s=%s\n", key, s.Tags[key])
+	}
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SetTag sets the tag key to value, removing it if value is empty
+func (s *Snapshot) SetTag(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "= \t\r\n") {
+		return fmt.Errorf("bad tag name %q", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("bad value for tag %q", key)
+	}
+	if value == "" {
+		delete(s.Tags, key)
+		return nil
+	}
+	if s.Tags == nil {
+		s.Tags = map[string]string{}
+	}
+	s.Tags[key] = value
+	return nil
 }
 
 // Parses the README.txt
-func (s *Snapshot) ParseReadme(readme string) {
+//
+// It returns the first error found parsing the values, but carries
+// on parsing the rest of the README.txt
+func (s *Snapshot) ParseReadme(readme string) (parseErr error) {
 	var err error
 	s.ReadMe = readme
-	for _, line := range strings.Split(readme, "\n") {
-		if !strings.Contains(line, "=") {
-			continue
-		}
-		tokens := strings.SplitN(line, "=", 2)
-		token := strings.ToLower(strings.TrimSpace(tokens[0]))
-		value := strings.TrimSpace(tokens[1])
+	s.readme = NewReadme(readme)
+	s.Tags = nil
+	s.Extra = nil
+	for _, key := range s.readme.Keys() {
+		token := strings.ToLower(key)
+		value, _ := s.readme.Get(key)
 		switch token {
 		case "user_comment":
 			s.Comment = value
 		case "date": // 2015-01-08T15:44:16.695676
 			s.Date, err = time.Parse(ReadmeDateFormat, value)
-			if err != nil {
-				log.Printf("Failed to parse date from %q: %v", value, err)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("failed to parse date from %q: %v", value, err)
 			}
 		case "miniserver": // myaccaa1
 			s.Miniserver = value
@@ -117,53 +184,131 @@ func (s *Snapshot) ParseReadme(readme string) {
 			s.ImageLeaf = value
 		case "md5(snapshot_image)": // 09e29a798ec4f3e4273981cc176adc32
 			s.Md5 = value
+		case "sha256(snapshot_image)": // 5f3c0f4f9ce4d6a4...
+			s.Sha256 = value
 		case "disk_size": // 42949672960
 			s.DiskSize, err = strconv.ParseInt(value, 10, 64)
-			if err != nil {
-				log.Printf("Failed to parse disk size from %q: %v", value, err)
+			if err != nil && parseErr == nil {
+				parseErr = fmt.Errorf("failed to parse disk size from %q: %v", value, err)
+			}
+		case "encryption": // aes-256-gcm-stream
+			s.Encryption = value
+		case "encryption_kdf": // pbkdf2-sha256
+			s.KeyKdf = value
+		case "encryption_key_fingerprint": // 3f2a9c0d41b7e865
+			s.KeyId = value
+		default:
+			if strings.HasPrefix(token, ReadmeTagPrefix) {
+				if s.Tags == nil {
+					s.Tags = map[string]string{}
+				}
+				s.Tags[key[len(ReadmeTagPrefix):]] = value
 			}
 		}
 	}
+	if unknown := s.readme.Unknown(); len(unknown) != 0 {
+		s.Extra = unknown
+	}
+	return parseErr
+}
+
+// ParsedReadme returns the README.txt parsed by ParseReadme or made
+// by CreateReadme, or nil if there isn't one
+func (s *Snapshot) ParsedReadme() *Readme {
+	return s.readme
 }
 
 // Creates the README from the Snapshot
+//
+// If the snapshot already has a README.txt then it is updated with
+// the values from the Snapshot, keeping its comments, the order of
+// its keys and any keys which aren't understood.
 func (s *Snapshot) CreateReadme() {
-	out := new(bytes.Buffer)
-	fmt.Fprintf(out, `; This directory contains a virtual machine disk image snapshot.
+	r := s.readme
+	if r == nil {
+		r = NewReadme(fmt.Sprintf(`; This directory contains a virtual machine disk image snapshot.
 ; The files in this directory are described below.
 ; For more information see: http://www.memset.com/docs/
 ;
 ; Uploaded by snapshot-manager on %v to %q
 ;
-`, time.Now(), s.Name)
-	if !s.Date.IsZero() {
-		fmt.Fprintf(out, "date = %s\n", s.Date.Format(ReadmeDateFormat))
+`, time.Now(), s.Name))
+		if s.Encryption != "" {
+			r = NewReadme(r.String() + `; The image is ENCRYPTED so can't be used by the Memset control panel.
+; Download it with snapshot-manager and the key to decrypt it.
+;
+`)
+		}
 	}
-	if s.Miniserver != "" {
-		fmt.Fprintf(out, "miniserver = %s\n", s.Miniserver)
+	set := func(key, value string) {
+		old, ok := r.Get(key)
+		if value == "" {
+			// only delete keys which have been cleared, keeping
+			// any which were empty in the original
+			if old != "" {
+				r.Delete(key)
+			}
+		} else if !ok || old != value {
+			// leave repeated keys alone unless the value read changed
+			r.Set(key, value)
+		}
 	}
-	if s.Comment != "" {
-		fmt.Fprintf(out, "user_comment = %s\n", s.Comment)
+	date := ""
+	if !s.Date.IsZero() {
+		date = s.Date.Format(ReadmeDateFormat)
+		// keep the original if it is the same date
+		if old, ok := r.Get("date"); ok {
+			if t, err := time.Parse(ReadmeDateFormat, old); err == nil && t.Equal(s.Date) {
+				date = old
+			}
+		}
 	}
-	if s.ImageType != "" {
-		fmt.Fprintf(out, "image_type = %s\n", s.ImageType)
+	set("date", date)
+	set("miniserver", s.Miniserver)
+	set("user_comment", s.Comment)
+	set("image_type", s.ImageType)
+	set("snapshot_image", s.ImageLeaf)
+	set("md5(snapshot_image)", s.Md5)
+	set("sha256(snapshot_image)", s.Sha256)
+	diskSize := ""
+	if s.DiskSize != 0 {
+		diskSize = strconv.FormatInt(s.DiskSize, 10)
+	}
+	set("disk_size", diskSize)
+	set("encryption", s.Encryption)
+	set("encryption_kdf", s.KeyKdf)
+	set("encryption_key_fingerprint", s.KeyId)
+
+	// Remove tags which have been deleted then set the rest
+	for _, key := range r.Keys() {
+		if strings.HasPrefix(strings.ToLower(key), ReadmeTagPrefix) {
+			if _, ok := s.Tags[key[len(ReadmeTagPrefix):]]; !ok {
+				r.Delete(key)
+			}
+		}
 	}
-	if s.ImageLeaf != "" {
-		fmt.Fprintf(out, "snapshot_image = %s\n", s.ImageLeaf)
+	for _, key := range sortedKeys(s.Tags) {
+		set(ReadmeTagPrefix+key, s.Tags[key])
 	}
-	if s.Md5 != "" {
-		fmt.Fprintf(out, "md5(snapshot_image) = %s\n", s.Md5)
+
+	// Remove unknown keys which have been deleted then set the rest
+	for key := range r.Unknown() {
+		if _, ok := s.Extra[key]; !ok {
+			r.Delete(key)
+		}
 	}
-	if s.DiskSize != 0 {
-		fmt.Fprintf(out, "disk_size = %d\n", s.DiskSize)
+	for _, key := range sortedKeys(s.Extra) {
+		set(key, s.Extra[key])
 	}
-	s.ReadMe = out.String()
+	s.readme = r
+	s.ReadMe = r.String()
 }
 
-// putChunkedFile puts in to continer/obectPath storing the chunks in
-// chunksContainer/chunksPath.  It returns the number of bytes
-// uploaded and an error
-func (s *Snapshot) putChunkedFile(in io.Reader, container, objectPath string, chunksContainer, chunksPath string, mimeType string) (int64, error) {
+// putChunkedFile puts in to chunksContainer/chunksPath in chunks,
+// each with its SHA-256 in its metadata.  The caller should put the
+// manifest with putManifest afterwards.  It returns the number of
+// bytes uploaded and an error
+func (s *Snapshot) putChunkedFile(in io.Reader, chunksContainer, chunksPath string, mimeType string) (int64, error) {
 	// Pool of buffers for upload
 	bufPool := sync.Pool{
 		New: func() interface{} {
@@ -180,11 +325,18 @@ func (s *Snapshot) putChunkedFile(in io.Reader, container, objectPath string, ch
 	uploads := make(chan upload, inFlight)
 	errs := make(chan error, inFlight)
 
-	// Read chunks from the file
+	// Read chunks from the file until the end or told to stop
 	size := int64(0)
-	finished := false
+	stop := make(chan struct{})
 	go func() {
+		finished := false
 		for chunk := 1; !finished; chunk++ {
+			select {
+			case <-stop:
+				finished = true
+				continue
+			default:
+			}
 			buf := bufPool.Get().([]byte)
 			n, err := io.ReadFull(in, buf)
 			size += int64(n)
@@ -210,33 +362,53 @@ func (s *Snapshot) putChunkedFile(in io.Reader, container, objectPath string, ch
 		for upload := range uploads {
 			// FIXME retry
 			log.Printf("Uploading chunk %q", upload.chunkPath)
-			err := s.Manager.Swift.ObjectPutBytes(container, upload.chunkPath, upload.buf[:upload.n], mimeType)
+			data := upload.buf[:upload.n]
+			h := sha256Headers(s.expiryHeaders(), fmt.Sprintf("%x", sha256.Sum256(data)))
+			h["Content-Length"] = strconv.Itoa(len(data))
+			start := time.Now()
+			_, err := s.Manager.Swift.ObjectPut(chunksContainer, upload.chunkPath, s.Manager.limitReader(bytes.NewReader(data)), true, "", mimeType, h)
 			if err != nil {
 				errs <- fmt.Errorf("failed to upload chunk %q: %v", upload.chunkPath, err)
+			} else {
+				s.Manager.Metrics.uploaded(len(data), time.Since(start))
 			}
 			bufPool.Put(upload.buf)
 		}
 		close(errs)
 	}()
 
-	// Collect errors
-	for err := range errs {
-		finished = true
-		return size, err
+	// Collect errors, waiting for the chunks in flight so none are
+	// still uploading when this returns
+	var err error
+	for uploadErr := range errs {
+		if err == nil {
+			close(stop)
+			err = uploadErr
+		}
 	}
+	return size, err
+}
 
-	// Put the manifest if all was successful
+// putManifest puts a manifest in container/objectPath for the chunks
+// in chunksContainer/chunksPath with the extra headers h
+func (s *Snapshot) putManifest(container, objectPath string, chunksContainer, chunksPath string, h swift.Headers) error {
 	log.Printf("Uploading manifest %q", objectPath)
 	contents := strings.NewReader("")
 	headers := swift.Headers{
 		"X-Object-Manifest": chunksContainer + "/" + chunksPath,
 	}
+	for k, v := range h {
+		headers[k] = v
+	}
 	_, err := s.Manager.Swift.ObjectPut(container, objectPath, contents, true, "", "application/octet-stream", headers)
-	return size, err
+	return err
 }
 
 // Download a snapshot into outputDirectory
-func (s *Snapshot) Get(outputDirectory string) error {
+func (s *Snapshot) Get(outputDirectory string) (err error) {
+	defer func() {
+		s.Manager.Metrics.record("download", err)
+	}()
 	objects, err := s.Manager.Objects(s.Name)
 	if len(objects) == 0 {
 		log.Fatal("Snapshot or snapshot objects not found")
@@ -253,23 +425,137 @@ func (s *Snapshot) Get(outputDirectory string) error {
 		if object.PseudoDirectory {
 			continue
 		}
-		objectPath := object.Name
-		leaf := path.Base(objectPath)
-		fmt.Printf("Downloading %s\n", objectPath)
-		out, err := os.Create(leaf)
+		err = s.getObject(object.Name)
 		if err != nil {
-			return fmt.Errorf("failed to open output file %q: %v", leaf, err)
+			return err
 		}
-		_, err = s.Manager.Swift.ObjectGet(s.Manager.Container, objectPath, out, true, nil)
+	}
+	return nil
+}
+
+// getObject downloads objectPath into the current directory
+//
+// Encrypted images are decrypted with the key from the Manager.  If
+// Manager.Decompress is set then gzipped images are decompressed and
+// disk images are written sparsely.  The MD5 and SHA-256 of the image
+// are checked against the README.txt.
+func (s *Snapshot) getObject(objectPath string) (err error) {
+	leaf, Type, decrypt, decompress := s.downloadName(objectPath)
+	fmt.Printf("Downloading %s\n", objectPath)
+	out, err := os.Create(leaf)
+	if err != nil {
+		return fmt.Errorf("failed to open output file %q: %v", leaf, err)
+	}
+	defer checkClose(out, &err)
+	var w io.Writer = out
+	if Type != nil && Type.Sparse {
+		sparseOut := NewSparseWriter(out)
+		defer checkClose(sparseOut, &err)
+		w = sparseOut
+	}
+	return s.copyObject(w, objectPath, leaf, decrypt, decompress)
+}
+
+// downloadName returns the leaf name objectPath is downloaded as, its
+// Type and whether it needs decrypting and decompressing
+func (s *Snapshot) downloadName(objectPath string) (leaf string, Type *Type, decrypt, decompress bool) {
+	leaf = path.Base(objectPath)
+	Type = Types.Find(leaf)
+	decrypt = Type != nil && strings.HasSuffix(leaf, EncryptedSuffix)
+	if decrypt {
+		leaf = leaf[:len(leaf)-len(EncryptedSuffix)]
+	}
+	decompress = s.Manager.Decompress && Type != nil && strings.HasSuffix(leaf, ".gz")
+	if decompress {
+		leaf = leaf[:len(leaf)-3]
+		Type = Types.Find(leaf)
+	}
+	return leaf, Type, decrypt, decompress
+}
+
+// DownloadName returns the name the image of the snapshot is
+// downloaded as
+func (s *Snapshot) DownloadName() string {
+	leaf, _, _, _ := s.downloadName(s.Path)
+	return leaf
+}
+
+// Download streams the image of the snapshot to w, decrypting and
+// decompressing it as Get does
+func (s *Snapshot) Download(w io.Writer) (err error) {
+	defer func() {
+		s.Manager.Metrics.record("download", err)
+	}()
+	if s.Broken || s.Path == "" {
+		return fmt.Errorf("snapshot %q is broken - nothing to download", s.Name)
+	}
+	leaf, _, decrypt, decompress := s.downloadName(s.Path)
+	return s.copyObject(w, s.Path, leaf, decrypt, decompress)
+}
+
+// copyObject streams objectPath to w as leaf, decrypting and
+// decompressing it if required, and checks its hashes if it is the
+// image
+func (s *Snapshot) copyObject(w io.Writer, objectPath, leaf string, decrypt, decompress bool) (err error) {
+	// Check the hashes of the image as stored as it is downloaded
+	hash := newImageHash()
+	var read countWriter
+	defer func() {
+		s.Manager.Metrics.downloaded(int(read))
+	}()
+	checkHashes := func() error {
+		if objectPath != s.Path {
+			return nil
+		}
+		err := s.checkHashes(hash)
 		if err != nil {
 			return fmt.Errorf("failed to download %q: %v", s.Name, err)
 		}
-		err = out.Close()
+		return nil
+	}
+	if !decrypt && !decompress {
+		_, err = s.Manager.Swift.ObjectGet(s.Manager.Container, objectPath, s.Manager.limitWriter(io.MultiWriter(w, hash, &read)), true, nil)
 		if err != nil {
-			return fmt.Errorf("failed to close %q: %v", s.Name, err)
+			return fmt.Errorf("failed to download %q: %v", s.Name, err)
 		}
+		return checkHashes()
 	}
-	return nil
+	object, _, err := s.Manager.Swift.ObjectOpen(s.Manager.Container, objectPath, true, nil)
+	if err != nil {
+		return fmt.Errorf("failed to download %q: %v", s.Name, err)
+	}
+	defer checkClose(object, &err)
+	stored := io.TeeReader(s.Manager.limitReader(object), io.MultiWriter(hash, &read))
+	in := stored
+	if decrypt {
+		fmt.Printf("Decrypting to %s\n", leaf)
+		decryptRd, err := NewDecryptReader(in, s.Manager.key())
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %q: %v", s.Name, err)
+		}
+		if s.KeyId != "" && decryptRd.Fingerprint != s.KeyId {
+			return fmt.Errorf("failed to decrypt %q: key fingerprint %s doesn't match %s in README.txt", s.Name, decryptRd.Fingerprint, s.KeyId)
+		}
+		in = decryptRd
+	}
+	if decompress {
+		fmt.Printf("Decompressing to %s\n", leaf)
+		gzipRd, err := gzip.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("failed to make gzip decompressor: %v", err)
+		}
+		defer checkClose(gzipRd, &err)
+		in = gzipRd
+	}
+	_, err = io.Copy(w, in)
+	if err == nil {
+		// read anything left after the end of the compressed data
+		_, err = io.Copy(io.Discard, stored)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %q: %v", s.Name, err)
+	}
+	return checkHashes()
 }
 
 // checkClose is used to check the return from Close in a defer
@@ -292,18 +578,10 @@ func (c *countWriter) Write(p []byte) (int, error) {
 
 // Puts a snapshot
 func (s *Snapshot) Put(file string) (err error) {
-	// Work out where to put things
-	leaf := s.ImageLeaf
-	Type := Types.Find(file)
-	if Type == nil {
-		return fmt.Errorf("unknown snapshot type %q - use types command to see available", leaf)
-	}
-	if !Type.Upload {
-		return fmt.Errorf("can't upload snapshot type %q - use types command to see available", leaf)
+	Type, err := s.uploadType(file)
+	if err != nil {
+		return err
 	}
-	s.ImageType = Type.ImageType
-	chunksPath := s.Name + "/" + leaf[:len(leaf)-len(Type.Suffix)] + ".part"
-	objectPath := s.Path
 
 	// Get file stat
 	fi, err := os.Stat(file)
@@ -315,6 +593,67 @@ func (s *Snapshot) Put(file string) (err error) {
 	}
 	s.Date = fi.ModTime()
 
+	// Upload the file with chunks
+	var in io.Reader
+	fileIn, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %v", file, err)
+	}
+	in = fileIn
+	defer checkClose(fileIn, &err)
+
+	// Skip over the holes in sparse disk images quickly
+	if Type.Sparse {
+		in, err = NewSparseReader(fileIn)
+		if err != nil {
+			return fmt.Errorf("failed to read %q: %v", file, err)
+		}
+	}
+	return s.put(in, Type, fi.Size())
+}
+
+// PutStream puts a snapshot of the image read from in which is size
+// bytes long, or -1 if that isn't known.  The type of the image comes
+// from the ImageLeaf set by NewSnapshotForUpload.
+func (s *Snapshot) PutStream(in io.Reader, size int64) error {
+	Type, err := s.uploadType(s.ImageLeaf)
+	if err != nil {
+		return err
+	}
+	s.Date = time.Now()
+	return s.put(in, Type, size)
+}
+
+// uploadType finds the Type of the image called name and checks it
+// can be uploaded
+func (s *Snapshot) uploadType(name string) (*Type, error) {
+	Type := Types.Find(name)
+	if Type == nil {
+		return nil, fmt.Errorf("unknown snapshot type %q - use types command to see available", s.ImageLeaf)
+	}
+	if !Type.Upload {
+		return nil, fmt.Errorf("can't upload snapshot type %q - use types command to see available", s.ImageLeaf)
+	}
+	if strings.HasSuffix(name, EncryptedSuffix) {
+		return nil, fmt.Errorf("can't upload %q - it is encrypted already", s.ImageLeaf)
+	}
+	return Type, nil
+}
+
+// put uploads the image of Type read from in as the snapshot
+//
+// fileSize is the size of the image or -1 if it isn't known, in which
+// case it is counted as it is read.
+func (s *Snapshot) put(in io.Reader, Type *Type, fileSize int64) (err error) {
+	defer func() {
+		s.Manager.Metrics.record("upload", err)
+	}()
+	// Work out where to put things
+	leaf := s.ImageLeaf
+	s.ImageType = Type.ImageType
+	chunksPath := s.chunksPath(leaf, Type)
+	objectPath := s.Path
+
 	// Check file doesn't exist and container does
 	ok, err := s.Exists()
 	if err != nil {
@@ -328,14 +667,11 @@ func (s *Snapshot) Put(file string) (err error) {
 		return err
 	}
 
-	// Upload the file with chunks
-	var in io.Reader
-	fileIn, err := os.Open(file)
-	if err != nil {
-		return fmt.Errorf("failed to open %q: %v", file, err)
+	// Count the size of the image if it isn't known
+	var read countWriter
+	if fileSize < 0 {
+		in = io.TeeReader(in, &read)
 	}
-	in = fileIn
-	defer checkClose(fileIn, &err)
 
 	// If we need to read the size from the ungzipped data then do
 	// it as we go along
@@ -369,7 +705,7 @@ func (s *Snapshot) Put(file string) (err error) {
 		objectPath += ".gz"
 		s.ImageLeaf += ".gz"
 		var gzipRd io.ReadCloser
-		gzipRd, err = NewGzipReader(in)
+		gzipRd, err = NewGzipReader(in, s.Manager.CompressLevel, s.Manager.CompressThreads)
 		if err != nil {
 			return fmt.Errorf("failed to make gzip compressor: %v", err)
 		}
@@ -377,28 +713,56 @@ func (s *Snapshot) Put(file string) (err error) {
 		in = gzipRd
 	}
 
-	// Calculate the MD5 of the uploaded object on the fly
-	hash := md5.New()
+	// Encrypt if we have a key, counting the size before encryption
+	var size countWriter
+	in = io.TeeReader(in, &size)
+	mimeType := Type.MimeType
+	if s.Manager.key().IsSet() {
+		log.Printf("Encrypting on the fly")
+		objectPath += EncryptedSuffix
+		s.ImageLeaf += EncryptedSuffix
+		mimeType = EncryptedMimeType
+		var encryptRd *EncryptReader
+		encryptRd, err = NewEncryptReader(in, s.Manager.key())
+		if err != nil {
+			return fmt.Errorf("failed to make encryptor: %v", err)
+		}
+		s.Encryption = EncryptionScheme
+		s.KeyKdf = encryptRd.Kdf
+		s.KeyId = encryptRd.Fingerprint
+		in = encryptRd
+	}
+
+	// Calculate the MD5 and SHA-256 of the uploaded object on the fly
+	hash := newImageHash()
 	in = io.TeeReader(in, hash)
 
 	// Put the file in chunks
-	size, err := s.putChunkedFile(in, s.Manager.Container, objectPath, s.Manager.Container, chunksPath, Type.MimeType)
+	_, err = s.putChunkedFile(in, s.Manager.Container, chunksPath, mimeType)
 	if err != nil {
 		return err
 	}
 
-	// Set the Md5
-	s.Md5 = fmt.Sprintf("%x", hash.Sum(nil))
+	// Set the hashes and put the manifest if all was successful
+	s.Md5 = hash.Md5()
+	s.Sha256 = hash.Sha256()
+	err = s.putManifest(s.Manager.Container, objectPath, s.Manager.Container, chunksPath, sha256Headers(s.expiryHeaders(), s.Sha256))
+	if err != nil {
+		return err
+	}
 
 	// Set the DiskSize to the raw size of the upload
+	if fileSize < 0 {
+		fileSize = int64(read)
+	}
 	switch Type.DiskSizeFrom {
 	case DiskSizeFromUpload:
 		// .tar.gz -> .tar
-		s.DiskSize = size
+		s.DiskSize = int64(size)
 	case DiskSizeFromFile:
 		// .raw -> raw.gz
 		// .tar
-		s.DiskSize = fi.Size()
+		s.DiskSize = fileSize
 	case DiskSizeFromGzip:
 		// .raw.gz
 		err = gzipCounter.Close()
@@ -408,13 +772,40 @@ func (s *Snapshot) Put(file string) (err error) {
 		s.DiskSize = gzipCounter.Size()
 	default:
 		log.Printf("Can't figure out the disk size for %q - using the file size", Type.Suffix)
-		s.DiskSize = fi.Size()
+		s.DiskSize = fileSize
 	}
 
-	// Write the README.txt
+	// Write the README.txt and sign it
+	return s.putReadmeSigned()
+}
+
+// Update rewrites the README.txt of an existing snapshot from its
+// fields, eg after changing the Comment or Tags
+func (s *Snapshot) Update() error {
+	if s.Broken {
+		return fmt.Errorf("snapshot %q is broken - use fsck to repair it", s.Name)
+	}
+	return s.putReadmeSigned()
+}
+
+// putReadmeSigned uploads the README.txt then signs it if the
+// Manager has a SignKey
+func (s *Snapshot) putReadmeSigned() error {
+	err := s.putReadme()
+	if err != nil {
+		return err
+	}
+	if s.Manager.SignKey == nil {
+		return nil
+	}
+	return s.Sign(s.Manager.SignKey)
+}
+
+// putReadme creates the README.txt from the Snapshot and uploads it
+func (s *Snapshot) putReadme() error {
 	s.CreateReadme()
 	log.Printf("Uploading README.txt\n%s\n", s.ReadMe)
-	err = s.Manager.Swift.ObjectPutString(s.Manager.Container, s.Name+"/README.txt", s.ReadMe, "text/plain")
+	_, err := s.Manager.Swift.ObjectPut(s.Manager.Container, s.Name+"/README.txt", strings.NewReader(s.ReadMe), true, "", "text/plain", s.expiryHeaders())
 	if err != nil {
 		return fmt.Errorf("failed to create README.txt: %v", err)
 	}
@@ -422,7 +813,16 @@ func (s *Snapshot) Put(file string) (err error) {
 }
 
 // Delete all the objects in the snapshot
-func (s *Snapshot) Delete() error {
+//
+// If Manager.SoftDelete is set then the snapshot is moved to the
+// trash instead unless it is in the trash already.
+func (s *Snapshot) Delete() (err error) {
+	defer func() {
+		s.Manager.Metrics.record("delete", err)
+	}()
+	if s.Manager.SoftDelete && !s.InTrash() {
+		return s.Trash()
+	}
 	objects, err := s.Manager.Swift.Objects(s.Manager.Container, &swift.ObjectsOpts{
 		Prefix: s.Name + "/",
 	})
@@ -433,20 +833,28 @@ func (s *Snapshot) Delete() error {
 		return fmt.Errorf("snapshot or snapshot objects not found")
 	}
 
-	errors := 0
-	for _, object := range objects {
-		if object.PseudoDirectory {
-			continue
-		}
-		log.Printf("Deleting %q", object.Name)
-		err = s.Manager.Swift.ObjectDelete(s.Manager.Container, object.Name)
-		if err != nil {
-			errors += 1
-			log.Printf("Failed to delete %q: %v", object.Name, err)
-		}
+	return s.Manager.DeleteObjects(objects)
+}
+
+// CleanUp deletes whatever a failed upload of the snapshot left
+// behind, including its chunks, so broken snapshots don't build up
+//
+// The objects are deleted straight away rather than moved to the
+// trash.  Only use it for a snapshot which Exists said wasn't there
+// before the upload started so an existing snapshot is never deleted.
+func (s *Snapshot) CleanUp() error {
+	objects, err := s.Manager.Swift.ObjectsAll(s.Manager.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err == swift.ContainerNotFound {
+		return nil
 	}
-	if errors != 0 {
-		return fmt.Errorf("failed to delete %d objects", errors)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
 	}
-	return nil
+	if len(objects) == 0 {
+		return nil
+	}
+	log.Printf("Cleaning up %d objects of failed snapshot %q", len(objects), s.Name)
+	return s.Manager.DeleteObjects(objects)
 }
@@ -0,0 +1,141 @@
+package snapshot
+
+import (
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the granularity used to detect zero blocks
+// when writing sparse files
+const sparseBlockSize = 4096
+
+// SparseReader reads a file skipping over the holes in it quickly.
+//
+// Holes are returned as zeros without reading them from the disk.
+// If the OS or file system doesn't support finding holes then the
+// whole file is read as normal.
+type SparseReader struct {
+	f       *os.File
+	size    int64
+	pos     int64 // current read position
+	dataEnd int64 // end of the current data region
+	holeEnd int64 // end of the current hole
+}
+
+// NewSparseReader makes a SparseReader reading f from the start
+func NewSparseReader(f *os.File) (*SparseReader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &SparseReader{
+		f:    f,
+		size: fi.Size(),
+	}, nil
+}
+
+// nextRegion finds whether the data at r.pos is in a hole or in a
+// data region and sets holeEnd or dataEnd accordingly
+func (r *SparseReader) nextRegion() {
+	data, hole, err := seekDataHole(r.f, r.pos)
+	if err != nil {
+		// Not supported so treat the rest of the file as data
+		r.dataEnd = r.size
+		return
+	}
+	if data > r.pos {
+		r.holeEnd = data
+	} else {
+		r.dataEnd = hole
+	}
+	if r.holeEnd > r.size {
+		r.holeEnd = r.size
+	}
+	if r.dataEnd > r.size {
+		r.dataEnd = r.size
+	}
+}
+
+// Read data from the file, returning zeros for holes
+func (r *SparseReader) Read(p []byte) (n int, err error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos >= r.holeEnd && r.pos >= r.dataEnd {
+		r.nextRegion()
+	}
+	if r.pos < r.holeEnd {
+		if int64(len(p)) > r.holeEnd-r.pos {
+			p = p[:r.holeEnd-r.pos]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		n = len(p)
+	} else {
+		if int64(len(p)) > r.dataEnd-r.pos {
+			p = p[:r.dataEnd-r.pos]
+		}
+		n, err = r.f.ReadAt(p, r.pos)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+	}
+	r.pos += int64(n)
+	return n, err
+}
+
+// SparseWriter writes to a file, seeking over blocks of zeros rather
+// than writing them so that the file is created sparse.
+//
+// You must call Close to set the final size of the file.
+type SparseWriter struct {
+	f   *os.File
+	pos int64
+}
+
+// NewSparseWriter makes a SparseWriter writing to f from the start
+func NewSparseWriter(f *os.File) *SparseWriter {
+	return &SparseWriter{
+		f: f,
+	}
+}
+
+// isZero returns whether p is all zeros
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Write data to the file skipping blocks of zeros
+func (w *SparseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Align the blocks to the file so holes can be made
+		n := sparseBlockSize - int(w.pos%sparseBlockSize)
+		if n > len(p) {
+			n = len(p)
+		}
+		block := p[:n]
+		if !isZero(block) {
+			_, err := w.f.WriteAt(block, w.pos)
+			if err != nil {
+				return written, err
+			}
+		}
+		w.pos += int64(n)
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close sets the size of the file to the amount written - this
+// creates any trailing hole.  It doesn't close the underlying file.
+func (w *SparseWriter) Close() error {
+	return w.f.Truncate(w.pos)
+}
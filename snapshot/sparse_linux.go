@@ -0,0 +1,40 @@
+//go:build linux
+// +build linux
+
+package snapshot
+
+import (
+	"os"
+	"syscall"
+)
+
+// lseek whence values for finding data and holes
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// seekDataHole returns the offset of the next data at or after
+// offset and the offset of the next hole after that.
+//
+// If there is no more data then it returns the size of the file as
+// data.
+func seekDataHole(f *os.File, offset int64) (data, hole int64, err error) {
+	fd := int(f.Fd())
+	data, err = syscall.Seek(fd, offset, seekData)
+	if err == syscall.ENXIO {
+		// no more data - the rest of the file is a hole
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+		return fi.Size(), fi.Size(), nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	hole, err = syscall.Seek(fd, data, seekHole)
+	if err != nil {
+		return 0, 0, err
+	}
+	return data, hole, nil
+}
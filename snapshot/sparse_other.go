@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package snapshot
+
+import (
+	"errors"
+	"os"
+)
+
+// seekDataHole isn't supported on this OS
+func seekDataHole(f *os.File, offset int64) (data, hole int64, err error) {
+	return 0, 0, errors.New("finding holes not supported")
+}
@@ -0,0 +1,143 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ncw/swift"
+)
+
+// Transfer copies the snapshot to the same name in dst, which is
+// usually a Manager for another account
+//
+// The objects are streamed from one to the other using
+// TransferThreads workers without touching local disk.  Each is
+// checked against the MD5 of the original as it is uploaded.  The
+// README.txt is copied unchanged last of all so the snapshot only
+// looks complete once everything else is there, then the copy is
+// verified.  If anything fails then what was copied is deleted so the
+// transfer can be tried again.
+func (s *Snapshot) Transfer(dst *Manager) (err error) {
+	sm := s.Manager
+	if s.Broken || s.Path == "" {
+		return fmt.Errorf("snapshot %q is broken - use fsck to repair it", s.Name)
+	}
+	headers, chunksContainer, chunksPrefix, err := s.Manifest()
+	if err != nil {
+		return err
+	}
+	if chunksContainer != "" && (chunksContainer != sm.Container || !strings.HasPrefix(chunksPrefix, s.Name+"/")) {
+		return fmt.Errorf("can't transfer snapshot %q with chunks outside it in %q", s.Name, chunksContainer+"/"+chunksPrefix)
+	}
+	d := dst.NewSnapshot(s.Name)
+	d.ExpireAt = s.ExpireAt
+	ok, err := d.Exists()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("snapshot %q already exists in the destination - delete it first", s.Name)
+	}
+	err = dst.CreateContainer()
+	if err != nil {
+		return err
+	}
+	// Safe as the snapshot didn't exist in the destination
+	defer func() {
+		if err == nil {
+			return
+		}
+		cleanUpErr := d.CleanUp()
+		if cleanUpErr != nil {
+			log.Printf("Failed to clean up transfer of snapshot %q: %v", s.Name, cleanUpErr)
+		}
+	}()
+
+	// Copy everything but the manifest and README.txt in parallel
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
+	}
+	readme := s.Name + "/README.txt"
+	var names []string
+	for _, object := range objects {
+		if object.PseudoDirectory || object.Name == readme || (object.Name == s.Path && chunksContainer != "") {
+			continue
+		}
+		names = append(names, object.Name)
+	}
+	errs := forEachThreads(sm.TransferThreads, names, func(name string) error {
+		return s.transferObject(d, name)
+	})
+	if len(errs) != 0 {
+		return &ObjectsError{Op: "transfer", Errors: errs}
+	}
+
+	// Make the manifest point to the chunks in the destination
+	if chunksContainer != "" {
+		h := headers.ObjectMetadata().ObjectHeaders()
+		for k, v := range d.expiryHeaders() {
+			h[k] = v
+		}
+		err = d.putManifest(dst.Container, s.Path, dst.Container, chunksPrefix, h)
+		if err != nil {
+			return fmt.Errorf("failed to transfer manifest %q: %v", s.Path, err)
+		}
+	}
+
+	// Copy the README.txt last
+	err = s.transferObject(d, readme)
+	if err != nil {
+		return fmt.Errorf("failed to transfer %q: %v", readme, err)
+	}
+	return s.checkTransfer(dst, headers)
+}
+
+// transferObject streams the object name to the snapshot d
+func (s *Snapshot) transferObject(d *Snapshot, name string) (err error) {
+	sm, dst := s.Manager, d.Manager
+	log.Printf("Transferring %q", name)
+	in, headers, err := sm.Swift.ObjectOpen(sm.Container, name, true, nil)
+	if err != nil {
+		return err
+	}
+	defer checkClose(in, &err)
+	h := headers.ObjectMetadata().ObjectHeaders()
+	for k, v := range d.expiryHeaders() {
+		h[k] = v
+	}
+	// Passing the ETag makes Memstore check the MD5 of the copy
+	_, err = dst.Swift.ObjectPut(dst.Container, name, in, true, strings.Trim(headers["Etag"], `"`), headers["Content-Type"], h)
+	return err
+}
+
+// checkTransfer verifies the copy of the snapshot in dst and checks
+// it has the same README.txt and chunks as the original, whose image
+// has headers
+func (s *Snapshot) checkTransfer(dst *Manager, headers swift.Headers) error {
+	d, err := dst.ReadSnapshot(s.Name)
+	if err != nil {
+		return err
+	}
+	if d.ReadMe != s.ReadMe {
+		return fmt.Errorf("README.txt of transferred snapshot %q differs from the original", s.Name)
+	}
+	results := d.Verify(false)
+	if VerifyFailed(results) {
+		for _, result := range results {
+			log.Printf("%v", result)
+		}
+		return fmt.Errorf("transferred snapshot %q failed verification", s.Name)
+	}
+	dstHeaders, _, _, err := d.Manifest()
+	if err != nil {
+		return err
+	}
+	if etag := dstHeaders["Etag"]; strings.Trim(etag, `"`) != strings.Trim(headers["Etag"], `"`) {
+		return fmt.Errorf("image of transferred snapshot %q has ETag %s not %s", s.Name, etag, headers["Etag"])
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package snapshot
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift"
+)
+
+// snapshotObjects returns the objects of the snapshot name which
+// aren't pseudo directories keyed by name
+func snapshotObjects(t *testing.T, sm *Manager, name string) map[string]swift.Object {
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{Prefix: name + "/"})
+	if err == swift.ContainerNotFound {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]swift.Object{}
+	for _, object := range objects {
+		if !object.PseudoDirectory {
+			byName[object.Name] = object
+		}
+	}
+	return byName
+}
+
+func TestTransfer(t *testing.T) {
+	src, _ := newTestManager(t)
+	dst, dstServer := newTestManager(t)
+	dst.Container = "other"
+	putTestSnapshot(t, src, "snap")
+	s, err := src.ReadSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fail the upload of the second chunk
+	chunk := "/v1/AUTH_swifttest/other/snap/image.part/00000002"
+	dstServer.SetOverride(chunk, func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	err = s.Transfer(dst)
+	if err == nil {
+		t.Fatal("transfer succeeded")
+	}
+	if left := snapshotObjects(t, dst, "snap"); len(left) != 0 {
+		t.Fatalf("failed transfer left %d objects", len(left))
+	}
+
+	// So trying again works
+	dstServer.UnsetOverride(chunk)
+	err = s.Transfer(dst)
+	if err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+	want := snapshotObjects(t, src, "snap")
+	got := snapshotObjects(t, dst, "snap")
+	if len(got) != len(want) {
+		t.Errorf("transferred %d objects want %d", len(got), len(want))
+	}
+	for name, object := range want {
+		if got[name].Hash != object.Hash {
+			t.Errorf("%s: ETag %q want %q", name, got[name].Hash, object.Hash)
+		}
+	}
+	d, err := dst.ReadSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.ReadMe != s.ReadMe {
+		t.Errorf("README.txt differs\ngot  %q\nwant %q", d.ReadMe, s.ReadMe)
+	}
+	var buf bytes.Buffer
+	err = d.Download(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), testImage(250000)) {
+		t.Errorf("transferred image of %d bytes differs", buf.Len())
+	}
+
+	// It won't overwrite the copy
+	err = s.Transfer(dst)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("transfer again: %v", err)
+	}
+	if got := snapshotObjects(t, dst, "snap"); len(got) != len(want) {
+		t.Errorf("transfer again left %d objects want %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,247 @@
+package snapshot
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+const (
+	// Prefix of the snapshots in the trash
+	TrashPrefix = ".trash/"
+	// How long snapshots stay in the trash by default
+	DefaultTrashExpire = 30 * 24 * time.Hour
+	// Metadata key recording the expiry a snapshot had before it was
+	// put in the trash so Undelete can restore it
+	trashExpireAtKey = "snapshot-expire-at"
+)
+
+// InTrash returns whether the snapshot is in the trash
+func (s *Snapshot) InTrash() bool {
+	return strings.HasPrefix(s.Name, TrashPrefix)
+}
+
+// trashedName returns the name the snapshot had before it was put in
+// the trash, eg ".trash/2015-01-11-12-33-39/new_image" is "new_image"
+func trashedName(name string) string {
+	tokens := strings.SplitN(strings.TrimPrefix(name, TrashPrefix), "/", 2)
+	if len(tokens) != 2 {
+		return name
+	}
+	return tokens[1]
+}
+
+// pseudoDirectories lists the names of the pseudo directories under
+// prefix without the trailing /
+func (sm *Manager) pseudoDirectories(prefix string) ([]string, error) {
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
+		Prefix:    prefix,
+		Delimiter: '/',
+	})
+	if err == swift.ContainerNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %v", prefix, err)
+	}
+	var names []string
+	for _, object := range objects {
+		if object.PseudoDirectory {
+			names = append(names, strings.TrimRight(object.Name, "/"))
+		}
+	}
+	return names, nil
+}
+
+// ListTrash lists all the snapshots in the trash, oldest first
+func (sm *Manager) ListTrash() ([]*Snapshot, error) {
+	dirs, err := sm.pseudoDirectories(TrashPrefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	var names []string
+	for _, dir := range dirs {
+		dirNames, err := sm.pseudoDirectories(dir + "/")
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, dirNames...)
+	}
+	snapshots, err := sm.readSnapshots(names)
+	if err != nil {
+		return nil, err
+	}
+	sm.saveCache(false)
+	return snapshots, nil
+}
+
+// FindTrash finds a snapshot in the trash.  name can be the full
+// name of the snapshot in the trash or the name it had before it was
+// deleted, in which case the most recently deleted one is returned.
+func (sm *Manager) FindTrash(name string) (*Snapshot, error) {
+	if strings.HasPrefix(name, TrashPrefix) {
+		s, err := sm.ReadSnapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := s.Exists()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("snapshot %q not found in the trash", name)
+		}
+		return s, nil
+	}
+	snapshots, err := sm.ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if trashedName(snapshots[i].Name) == name {
+			return snapshots[i], nil
+		}
+	}
+	return nil, fmt.Errorf("snapshot %q not found in the trash", name)
+}
+
+// moveTo copies all the objects of the snapshot to be under newName
+// rewriting the manifest of the image to point to the copied
+// chunks, then deletes the originals.
+//
+// h are extra headers to set on the copies.  If fresh is set then
+// only the user metadata of the objects is copied, less the expiry
+// recorded by Trash, which removes any expiry.
+func (s *Snapshot) moveTo(newName string, h swift.Headers, fresh bool) error {
+	sm := s.Manager
+	objects, err := sm.Swift.ObjectsAll(sm.Container, &swift.ObjectsOpts{
+		Prefix: s.Name + "/",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot %q: %v", s.Name, err)
+	}
+	if len(objects) == 0 {
+		return fmt.Errorf("snapshot or snapshot objects not found")
+	}
+	chunksContainer, chunksPrefix := "", ""
+	if s.Path != "" {
+		_, chunksContainer, chunksPrefix, err = s.Manifest()
+		if err != nil {
+			return err
+		}
+	}
+	rename := func(name string) string {
+		return newName + strings.TrimPrefix(name, s.Name)
+	}
+	newChunksPrefix := chunksPrefix
+	if chunksContainer == sm.Container && strings.HasPrefix(chunksPrefix, s.Name+"/") {
+		newChunksPrefix = rename(chunksPrefix)
+	}
+
+	// headers returns the headers to copy object name with
+	headers := func(name string) (swift.Headers, error) {
+		out := swift.Headers{}
+		if fresh {
+			_, objectHeaders, err := sm.Swift.Object(sm.Container, name)
+			if err != nil {
+				return nil, err
+			}
+			metadata := objectHeaders.ObjectMetadata()
+			delete(metadata, trashExpireAtKey)
+			out = metadata.ObjectHeaders()
+			out["X-Fresh-Metadata"] = "true"
+			out["Content-Type"] = objectHeaders["Content-Type"]
+		}
+		for k, v := range h {
+			out[k] = v
+		}
+		return out, nil
+	}
+
+	// Copy the objects in parallel
+	var names []string
+	for _, object := range objects {
+		if !object.PseudoDirectory {
+			names = append(names, object.Name)
+		}
+	}
+	errs := sm.forEach(names, func(name string) error {
+		copyHeaders, err := headers(name)
+		if err != nil {
+			return err
+		}
+		if name == s.Path && chunksContainer != "" {
+			// Make a new manifest rather than copying the
+			// image the manifest refers to
+			delete(copyHeaders, "X-Fresh-Metadata")
+			delete(copyHeaders, "Content-Type")
+			return s.putManifest(sm.Container, rename(name), chunksContainer, newChunksPrefix, copyHeaders)
+		}
+		log.Printf("Copying %q to %q", name, rename(name))
+		_, err = sm.Swift.ObjectCopy(sm.Container, name, sm.Container, rename(name), copyHeaders)
+		return err
+	})
+	if len(errs) != 0 {
+		return &ObjectsError{Op: "copy", Errors: errs}
+	}
+	return sm.DeleteObjects(objects)
+}
+
+// Trash moves the snapshot into the trash where it is deleted
+// automatically after Manager.TrashExpire, or when it was due to
+// expire if that is sooner.  It can be restored with Undelete until
+// then.
+func (s *Snapshot) Trash() error {
+	if s.InTrash() {
+		return fmt.Errorf("snapshot %q is already in the trash", s.Name)
+	}
+	trashName := TrashPrefix + time.Now().UTC().Format(DirectoryDate) + "/" + s.Name
+	log.Printf("Moving %q to the trash as %q", s.Name, trashName)
+	h := swift.Headers{
+		"X-Delete-After": strconv.FormatInt(int64(s.Manager.TrashExpire/time.Second), 10),
+	}
+	if !s.ExpireAt.IsZero() {
+		expireAt := strconv.FormatInt(s.ExpireAt.Unix(), 10)
+		for k, v := range (swift.Metadata{trashExpireAtKey: expireAt}).ObjectHeaders() {
+			h[k] = v
+		}
+		if s.ExpireAt.Before(time.Now().Add(s.Manager.TrashExpire)) {
+			delete(h, "X-Delete-After")
+			h["X-Delete-At"] = expireAt
+		}
+	}
+	return s.moveTo(trashName, h, false)
+}
+
+// Undelete restores a snapshot from the trash to the name it had
+// before it was deleted
+func (s *Snapshot) Undelete() error {
+	if !s.InTrash() {
+		return fmt.Errorf("snapshot %q is not in the trash", s.Name)
+	}
+	name := trashedName(s.Name)
+	ok, err := s.Manager.NewSnapshot(name).Exists()
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("snapshot %q already exists - delete it first", name)
+	}
+	// Restore the expiry recorded by Trash
+	var h swift.Headers
+	_, headers, err := s.Manager.Swift.Object(s.Manager.Container, s.Name+"/README.txt")
+	if err != nil && err != swift.ObjectNotFound {
+		return fmt.Errorf("failed to read README.txt of %q: %v", s.Name, err)
+	}
+	if expireAt := headers.ObjectMetadata()[trashExpireAtKey]; expireAt != "" {
+		h = swift.Headers{"X-Delete-At": expireAt}
+	}
+	log.Printf("Restoring %q from the trash as %q", s.Name, name)
+	return s.moveTo(name, h, true)
+}
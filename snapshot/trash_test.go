@@ -0,0 +1,140 @@
+package snapshot
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncw/swift"
+)
+
+// expiryTransport adds the expiry of objects which swifttest doesn't
+// support.  It remembers the X-Delete-At or X-Delete-After set when
+// objects are written and returns it when they are read, and records
+// the headers of the COPY requests.
+type expiryTransport struct {
+	mu       sync.Mutex
+	deleteAt map[string]string // object path to X-Delete-At
+	copies   []http.Header
+}
+
+// RoundTrip does the request keeping track of the expiry
+func (et *expiryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil || resp.StatusCode >= 300 {
+		return resp, err
+	}
+	et.mu.Lock()
+	defer et.mu.Unlock()
+	path := req.URL.Path
+	deleteAt := req.Header.Get("X-Delete-At")
+	if after := req.Header.Get("X-Delete-After"); after != "" {
+		seconds, _ := strconv.ParseInt(after, 10, 64)
+		deleteAt = strconv.FormatInt(time.Now().Unix()+seconds, 10)
+	}
+	switch req.Method {
+	case "PUT", "POST":
+		et.deleteAt[path] = deleteAt
+	case "COPY":
+		et.copies = append(et.copies, req.Header.Clone())
+		if deleteAt == "" && req.Header.Get("X-Fresh-Metadata") != "true" {
+			deleteAt = et.deleteAt[path]
+		}
+		destination, _ := url.PathUnescape(req.Header.Get("Destination"))
+		et.deleteAt[path[:strings.Index(path[1:], "/")+1]+"/AUTH_swifttest/"+destination] = deleteAt
+	case "DELETE":
+		delete(et.deleteAt, path)
+	case "GET", "HEAD":
+		if deleteAt := et.deleteAt[path]; deleteAt != "" {
+			resp.Header.Set("X-Delete-At", deleteAt)
+		}
+	}
+	return resp, nil
+}
+
+func TestTrashUndeleteExpiry(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		expireIn time.Duration // expiry before deletion or 0 for none
+		trashIn  time.Duration // expiry in the trash
+	}{
+		{"no expiry", 0, DefaultTrashExpire},
+		{"expires after the trash", 60 * 24 * time.Hour, DefaultTrashExpire},
+		{"expires before the trash", 2 * 24 * time.Hour, 2 * 24 * time.Hour},
+	} {
+		sm, server := newTestManager(t)
+		sm.SoftDelete = true
+		et := &expiryTransport{deleteAt: map[string]string{}}
+		sm.Swift = &swift.Connection{
+			UserName:  "swifttest",
+			ApiKey:    "swifttest",
+			AuthUrl:   server.AuthURL,
+			Transport: et,
+		}
+		err := sm.Swift.Authenticate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		putTestSnapshot(t, sm, "snap")
+		s, err := sm.ReadSnapshot("snap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expireAt time.Time
+		if test.expireIn != 0 {
+			expireAt = time.Now().Add(test.expireIn).Truncate(time.Second)
+			err = s.SetExpiry(expireAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = s.Delete()
+		if err != nil {
+			t.Fatalf("%s: delete failed: %v", test.name, err)
+		}
+
+		trashed, err := sm.FindTrash("snap")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got := time.Until(trashed.ExpireAt); got < test.trashIn-time.Minute || got > test.trashIn {
+			t.Errorf("%s: expires in %v in the trash want %v", test.name, got, test.trashIn)
+		}
+		et.copies = nil
+		err = trashed.Undelete()
+		if err != nil {
+			t.Fatalf("%s: undelete failed: %v", test.name, err)
+		}
+		// The copies are made with fresh metadata less that of the trash
+		if len(et.copies) == 0 {
+			t.Errorf("%s: nothing copied", test.name)
+		}
+		for _, h := range et.copies {
+			if h.Get("X-Fresh-Metadata") != "true" || h.Get("X-Object-Meta-"+trashExpireAtKey) != "" {
+				t.Errorf("%s: restored with headers %v", test.name, h)
+			}
+		}
+
+		restored, err := sm.ReadSnapshot("snap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !restored.ExpireAt.Equal(expireAt) {
+			t.Errorf("%s: restored expiry %v want %v", test.name, restored.ExpireAt, expireAt)
+		}
+		// Every object has the expiry restored
+		for name := range snapshotObjects(t, sm, "snap") {
+			_, headers, err := sm.Swift.Object(sm.Container, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parseExpiry(headers); !got.Equal(expireAt) {
+				t.Errorf("%s: %s expires at %v want %v", test.name, name, got, expireAt)
+			}
+		}
+	}
+}
@@ -26,6 +26,7 @@ type Type struct {
 	NeedsGzip      bool
 	NeedsGunzip    bool
 	DiskSizeFrom   DiskSizeFrom
+	Sparse         bool // disk image which is read and written sparsely
 }
 
 // A list of types
@@ -70,6 +71,7 @@ var Types = types{
 		MimeType:       "x-application/x-gzip",
 		NeedsGzip:      true,
 		DiskSizeFrom:   DiskSizeFromFile,
+		Sparse:         true,
 	},
 	{
 		Suffix:         ".xmbr",
@@ -107,8 +109,11 @@ var Types = types{
 
 // Finds the best match for Type for the file passed in
 //
+// The EncryptedSuffix of encrypted images is ignored.
+//
 // Returns nil if not found
 func (ts types) Find(file string) *Type {
+	file = strings.TrimSuffix(file, EncryptedSuffix)
 	for i := range ts {
 		Type := &ts[i]
 		if strings.HasSuffix(file, Type.Suffix) {
@@ -118,6 +123,19 @@ func (ts types) Find(file string) *Type {
 	return nil
 }
 
+// Finds the Type which is stored with the mimeType passed in
+//
+// Returns nil if not found
+func (ts types) FindMimeType(mimeType string) *Type {
+	for i := range ts {
+		Type := &ts[i]
+		if Type.MimeType == mimeType && Type.Upload && !Type.NeedsGzip && !Type.NeedsGunzip {
+			return Type
+		}
+	}
+	return nil
+}
+
 // Lists all the snapshot types to an io.Writer
 func (ts types) List(out io.Writer) {
 	for i := range ts {
@@ -0,0 +1,262 @@
+package snapshot
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// VerifyResult is the outcome of a single check made by Verify
+type VerifyResult struct {
+	Check   string // name of the check
+	Err     error  // set if the check failed
+	Skipped bool   // set if the check couldn't be made
+}
+
+// String shows the result in a form suitable for the user
+func (r VerifyResult) String() string {
+	switch {
+	case r.Skipped:
+		return fmt.Sprintf("SKIP %-9s - %v", r.Check, r.Err)
+	case r.Err != nil:
+		return fmt.Sprintf("FAIL %-9s - %v", r.Check, r.Err)
+	}
+	return fmt.Sprintf("PASS %-9s", r.Check)
+}
+
+// VerifyFailed returns whether any of the results failed
+func VerifyFailed(results []VerifyResult) bool {
+	for _, r := range results {
+		if r.Err != nil && !r.Skipped {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks the snapshot is intact without downloading it
+//
+// It checks the README.txt parses, the manifest references the
+// chunks, the chunks are contiguous and their ETags match the
+// manifest.  If deep is set then it also reads the whole image and
+// checks its MD5 and SHA-256 match those in the README.txt and the
+// SHA-256 of each chunk matches its metadata.
+func (s *Snapshot) Verify(deep bool) []VerifyResult {
+	var results []VerifyResult
+	pass := func(check string) {
+		results = append(results, VerifyResult{Check: check})
+	}
+	fail := func(check string, err error) {
+		results = append(results, VerifyResult{Check: check, Err: err})
+	}
+	skip := func(check string, reason string) {
+		results = append(results, VerifyResult{Check: check, Err: errors.New(reason), Skipped: true})
+	}
+	skipAll := func(reason string, checks ...string) []VerifyResult {
+		for _, check := range checks {
+			skip(check, reason)
+		}
+		return results
+	}
+
+	// Check the README.txt
+	if s.ReadMe == "" {
+		fail("readme", errors.New("README.txt missing or empty"))
+	} else if err := new(Snapshot).ParseReadme(s.ReadMe); err != nil {
+		fail("readme", err)
+	} else if s.Md5 == "" || s.ImageLeaf == "" {
+		fail("readme", errors.New("README.txt missing snapshot_image or md5(snapshot_image)"))
+	} else {
+		pass("readme")
+	}
+
+	// Check the manifest
+	if s.Broken || s.Path == "" {
+		fail("manifest", errors.New("snapshot image not found"))
+		return skipAll("no manifest", "chunks", "etags", "md5", "sha256", "chunkhash")
+	}
+	headers, chunksContainer, chunksPrefix, err := s.Manifest()
+	if err != nil {
+		fail("manifest", err)
+		return skipAll("no manifest", "chunks", "etags", "md5", "sha256", "chunkhash")
+	}
+	var chunks []*chunkInfo
+	chunksOK := false
+	if chunksContainer == "" {
+		pass("manifest")
+		skipAll("image is not chunked", "chunks", "etags")
+	} else if chunksContainer != s.Manager.Container || !strings.HasPrefix(chunksPrefix, s.Name+"/") {
+		fail("manifest", fmt.Errorf("manifest references chunks %q outside the snapshot", chunksContainer+"/"+chunksPrefix))
+		skipAll("bad manifest", "chunks", "etags")
+	} else {
+		pass("manifest")
+		chunks, err = s.verifyChunks(chunksContainer, chunksPrefix)
+		if err != nil {
+			fail("chunks", err)
+		} else {
+			pass("chunks")
+			chunksOK = true
+		}
+		if len(chunks) == 0 {
+			skip("etags", "no chunks")
+		} else if err = verifyEtags(chunks, headers["Etag"]); err != nil {
+			fail("etags", err)
+		} else {
+			pass("etags")
+		}
+	}
+
+	// Check the hashes of the whole image
+	if !deep {
+		return skipAll("use -deep to check", "md5", "sha256", "chunkhash")
+	}
+	if !chunksOK {
+		chunks = nil
+	}
+	hash, chunkErr, err := s.readImage(chunks)
+	if err != nil {
+		// An image which can't be read is broken
+		for _, check := range []string{"md5", "sha256", "chunkhash"} {
+			fail(check, err)
+		}
+		return results
+	}
+	if s.Md5 == "" {
+		skip("md5", "no MD5 in README.txt")
+	} else if err = s.checkMd5(hash); err != nil {
+		fail("md5", err)
+	} else {
+		pass("md5")
+	}
+	if s.Sha256 == "" {
+		skip("sha256", "no SHA-256 in README.txt")
+	} else if err = s.checkSha256(hash); err != nil {
+		fail("sha256", err)
+	} else {
+		pass("sha256")
+	}
+	if len(chunks) == 0 {
+		skip("chunkhash", "image is not chunked")
+	} else if chunkErr == errNoChunkHashes {
+		skip("chunkhash", chunkErr.Error())
+	} else if chunkErr != nil {
+		fail("chunkhash", chunkErr)
+	} else {
+		pass("chunkhash")
+	}
+	return results
+}
+
+// chunkInfo is the number and hash of a chunk
+type chunkInfo struct {
+	name string
+	n    int
+	hash string
+}
+
+// verifyChunks checks the chunks are numbered 1..N without gaps
+//
+// It returns the chunks it found in order
+func (s *Snapshot) verifyChunks(container, prefix string) ([]*chunkInfo, error) {
+	objects, err := s.Manager.Chunks(container, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no chunks found under %q", prefix)
+	}
+	var chunks []*chunkInfo
+	for _, object := range objects {
+		n, err := chunkNumber(object.Name)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, &chunkInfo{
+			name: object.Name,
+			n:    n,
+			hash: object.Hash,
+		})
+	}
+	for i, chunk := range chunks {
+		if chunk.n != i+1 {
+			return chunks, fmt.Errorf("expecting chunk %d but found %q", i+1, chunk.name)
+		}
+	}
+	return chunks, nil
+}
+
+// verifyEtags checks each chunk has a valid ETag and that the ETag
+// of the manifest is the MD5 of the chunk ETags concatenated
+func verifyEtags(chunks []*chunkInfo, manifestEtag string) error {
+	hash := md5.New()
+	for _, chunk := range chunks {
+		if len(chunk.hash) != md5.Size*2 {
+			return fmt.Errorf("chunk %q has bad ETag %q", chunk.name, chunk.hash)
+		}
+		_, _ = io.WriteString(hash, chunk.hash)
+	}
+	manifestEtag = strings.Trim(manifestEtag, `"`)
+	if manifestEtag == "" {
+		return errors.New("manifest has no ETag")
+	}
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	if sum != manifestEtag {
+		return fmt.Errorf("manifest ETag %q doesn't match chunks %q", manifestEtag, sum)
+	}
+	return nil
+}
+
+// errNoChunkHashes is returned by readImage if none of the chunks
+// have a SHA-256 in their metadata
+var errNoChunkHashes = errors.New("no SHA-256 in chunk metadata")
+
+// readImage reads the whole image and returns its hashes
+//
+// If chunks is set then the image is read chunk by chunk, checking
+// the SHA-256 of each against its metadata and returning the first
+// mismatch as chunkErr.  Otherwise it is read through the manifest.
+func (s *Snapshot) readImage(chunks []*chunkInfo) (hash *imageHash, chunkErr error, err error) {
+	hash = newImageHash()
+	if len(chunks) == 0 {
+		err = s.readObject(s.Path, hash)
+		return hash, nil, err
+	}
+	hashed := 0
+	for _, chunk := range chunks {
+		chunkHash := sha256.New()
+		headers, err := s.Manager.Swift.ObjectGet(s.Manager.Container, chunk.name, io.MultiWriter(hash, chunkHash), false, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %q: %v", chunk.name, err)
+		}
+		want := headers[Sha256Header]
+		if want == "" {
+			continue
+		}
+		hashed++
+		sum := fmt.Sprintf("%x", chunkHash.Sum(nil))
+		if sum != strings.ToLower(want) && chunkErr == nil {
+			chunkErr = fmt.Errorf("SHA-256 of chunk %q is %q not %q", chunk.name, sum, want)
+		}
+	}
+	if hashed == 0 {
+		chunkErr = errNoChunkHashes
+	}
+	return hash, chunkErr, nil
+}
+
+// readObject reads the whole of objectPath into w
+func (s *Snapshot) readObject(objectPath string, w io.Writer) (err error) {
+	in, _, err := s.Manager.Swift.ObjectOpen(s.Manager.Container, objectPath, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %v", objectPath, err)
+	}
+	defer checkClose(in, &err)
+	_, err = io.Copy(w, in)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %v", objectPath, err)
+	}
+	return nil
+}
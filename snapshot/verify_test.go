@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ncw/swift"
+)
+
+// putTestSnapshot uploads a snapshot of 3 chunks returning the name
+// of its second chunk
+func putTestSnapshot(t *testing.T, sm *Manager, name string) string {
+	s := sm.NewSnapshotForUpload(name, "image.tar")
+	err := s.PutStream(bytes.NewReader(testImage(250000)), 250000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	objects, err := sm.Swift.ObjectNamesAll(sm.Container, &swift.ObjectsOpts{Prefix: name + "/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, object := range objects {
+		if strings.HasSuffix(object, "/00000002") {
+			return object
+		}
+	}
+	t.Fatalf("no second chunk in %q", objects)
+	return ""
+}
+
+// verifyResults verifies the snapshot name returning the results
+// keyed by check
+func verifyResults(t *testing.T, sm *Manager, name string, deep bool) (map[string]VerifyResult, bool) {
+	s, err := sm.ReadSnapshot(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := s.Verify(deep)
+	byCheck := map[string]VerifyResult{}
+	for _, result := range results {
+		byCheck[result.Check] = result
+	}
+	return byCheck, VerifyFailed(results)
+}
+
+func TestVerify(t *testing.T) {
+	sm, _ := newTestManager(t)
+	putTestSnapshot(t, sm, "snap")
+	results, failed := verifyResults(t, sm, "snap", true)
+	if failed {
+		t.Errorf("intact snapshot failed: %v", results)
+	}
+	for _, check := range []string{"readme", "manifest", "chunks", "etags", "md5", "sha256", "chunkhash"} {
+		if result := results[check]; result.Err != nil {
+			t.Errorf("%s: %v", check, result)
+		}
+	}
+
+	results, failed = verifyResults(t, sm, "snap", false)
+	if failed {
+		t.Errorf("shallow verify failed: %v", results)
+	}
+	if !results["md5"].Skipped {
+		t.Errorf("shallow verify checked the MD5: %v", results["md5"])
+	}
+}
+
+func TestVerifyChunkDeleted(t *testing.T) {
+	sm, _ := newTestManager(t)
+	chunk := putTestSnapshot(t, sm, "snap")
+	err := sm.Swift.ObjectDelete(sm.Container, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, failed := verifyResults(t, sm, "snap", true)
+	if !failed {
+		t.Fatalf("snapshot with a deleted chunk verified OK: %v", results)
+	}
+	if results["chunks"].Err == nil {
+		t.Errorf("missing chunk not found: %v", results["chunks"])
+	}
+}
+
+func TestVerifyChunkUnreadable(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusInternalServerError} {
+		sm, server := newTestManager(t)
+		chunk := putTestSnapshot(t, sm, "snap")
+		// The chunk is listed but reading it fails
+		server.SetOverride("/v1/AUTH_swifttest/"+sm.Container+"/"+chunk, func(w http.ResponseWriter, r *http.Request, recorder *httptest.ResponseRecorder) {
+			if r.Method == "GET" {
+				w.WriteHeader(status)
+				return
+			}
+			for k, v := range recorder.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(recorder.Code)
+			_, _ = w.Write(recorder.Body.Bytes())
+		})
+		results, failed := verifyResults(t, sm, "snap", true)
+		if !failed {
+			t.Fatalf("%d: snapshot with an unreadable chunk verified OK: %v", status, results)
+		}
+		if results["chunks"].Err != nil {
+			t.Errorf("%d: chunks check failed: %v", status, results["chunks"])
+		}
+		for _, check := range []string{"md5", "sha256", "chunkhash"} {
+			result := results[check]
+			if result.Err == nil || result.Skipped {
+				t.Errorf("%d: want %s to fail got %v", status, check, result)
+			}
+		}
+	}
+}